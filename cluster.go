@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/knaw-huc/levenserv/internal/vp"
+)
+
+// A clusterIndex can group its strings into clusters.
+type clusterIndex interface {
+	index
+	Cluster(ctx context.Context, threshold float64, pred vp.Predicate[string]) ([]vp.Cluster[string], error)
+}
+
+var errNoCluster = errors.New(
+	"clustering is only available for unsharded, non-flat vp indexes")
+
+// A clusterHit is a cluster as sent to the client. The distance of each
+// member is its distance to the medoid.
+type clusterHit struct {
+	Medoid  hit   `json:"medoid"`
+	Members []hit `json:"members"`
+}
+
+// cluster groups the strings in i.index that match pred into clusters of
+// strings within distance threshold of each other, as by vp.Tree.Cluster.
+// Clusters with fewer than minSize members are left out.
+func (i *nnIndex) cluster(ctx context.Context, threshold float64, pred vp.Predicate[string], minSize int) ([]clusterHit, error) {
+	idx, ok := i.index.(clusterIndex)
+	if !ok {
+		return nil, errNoCluster
+	}
+	clusters, err := idx.Cluster(ctx, threshold, pred)
+	if err != nil {
+		return nil, err
+	}
+
+	hits := make([]clusterHit, 0, len(clusters))
+	for _, c := range clusters {
+		if len(c.Members) < minSize {
+			break // Clusters are sorted by size.
+		}
+		members := toHits(c.Members)
+		hits = append(hits, clusterHit{Medoid: members[0], Members: members})
+	}
+	return hits, nil
+}
+
+// writeClusters writes the clusters of the strings in i.index that match
+// the regular expression pattern to w, as newline-delimited JSON.
+func (i *nnIndex) writeClusters(ctx context.Context, threshold float64, pattern string, w io.Writer) error {
+	pred, err := compilePredicate(pattern)
+	if err != nil {
+		return err
+	}
+	clusters, err := i.cluster(ctx, threshold, pred, 0)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	for _, c := range clusters {
+		if err := enc.Encode(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
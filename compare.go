@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/knaw-huc/levenserv/internal/vp"
+)
+
+// Number of nearest neighbors compared per query by -compare.
+const compareK = 10
+
+// compare runs a k-nearest neighbors search for each of the queries on
+// i.index and on a linear scan over keys, which should be the strings that
+// i.index was built from. It writes a report of the queries for which they
+// disagree to w and returns the number of such queries.
+//
+// The linear scan is built from keys rather than from i.index, so that
+// strings that i.index has lost or duplicated show up as mismatches.
+func (i *nnIndex) compare(keys, queries []string, w io.Writer) (mismatches int, err error) {
+	ref := vp.NewLinear(i.metric, keys, nil)
+
+	ctx := context.Background()
+	for _, q := range queries {
+		q = i.normalizeQuery(q)
+		got, err := i.index.Search(ctx, q, compareK, math.Inf(+1), nil)
+		if err != nil {
+			return mismatches, err
+		}
+		expect, err := ref.Search(ctx, q, compareK, math.Inf(+1), nil)
+		if err != nil {
+			return mismatches, err
+		}
+
+		if !sameResults(got, expect) {
+			mismatches++
+			fmt.Fprintf(w, "query %q:\n  index:  %s\n  linear: %s\n",
+				q, formatResults(got), formatResults(expect))
+		}
+	}
+	return mismatches, nil
+}
+
+// sameResults reports whether a and b are equally good answers to a query:
+// they have the same distances, and the same points with the same counts
+// except at the largest distance, where ties may have been broken
+// differently.
+func sameResults(a, b []vp.Result[string]) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	if len(a) == 0 {
+		return true
+	}
+
+	last := a[len(a)-1].Dist
+	counts := make(map[string]int)
+	for j := range a {
+		if a[j].Dist != b[j].Dist {
+			return false
+		}
+		if a[j].Dist < last {
+			counts[a[j].Point] = a[j].Count
+		}
+	}
+	for _, r := range b {
+		if r.Dist >= last {
+			continue
+		}
+		if count, ok := counts[r.Point]; !ok || count != r.Count {
+			return false
+		}
+	}
+	return true
+}
+
+func formatResults(results []vp.Result[string]) string {
+	s := ""
+	for j, r := range results {
+		if j > 0 {
+			s += ", "
+		}
+		s += fmt.Sprintf("%q (%g)", r.Point, r.Dist)
+	}
+	return s
+}
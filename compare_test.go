@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/knaw-huc/levenserv/internal/vp"
+)
+
+func TestCompare(t *testing.T) {
+	keys := []string{"foo", "bar", "baz", "quux", "food", "fool"}
+	queries := []string{"fo", "bax", "quuz", ""}
+	for _, typ := range []string{"vp", "mvp", "bktree"} {
+		idx := nnIndex{indexType: typ, metricName: "levenshtein", timeout: time.Second}
+		if _, err := idx.init(keys); err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		n, err := idx.compare(keys, queries, &buf)
+		if err != nil || n != 0 {
+			t.Errorf("%s: %d mismatches, error %v:\n%s", typ, n, err, buf.String())
+		}
+	}
+
+	// An index that has lost a string or counts one twice must not pass.
+	for _, built := range [][]string{keys[1:], append(keys, "bar")} {
+		idx := nnIndex{metricName: "levenshtein", timeout: time.Second}
+		if _, err := idx.init(built); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		n, err := idx.compare(keys, queries, &buf)
+		if err != nil || n == 0 {
+			t.Errorf("index of %v: %d mismatches, error %v", built, n, err)
+		}
+	}
+}
+
+func TestSameResults(t *testing.T) {
+	r := func(point string, dist float64) vp.Result[string] {
+		return vp.Result[string]{Point: point, Dist: dist}
+	}
+	for _, c := range []struct {
+		a, b []vp.Result[string]
+		same bool
+	}{
+		{nil, nil, true},
+		{[]vp.Result[string]{r("a", 0)}, nil, false},
+		// Ties at the k-th distance may be broken differently.
+		{
+			[]vp.Result[string]{r("a", 0), r("b", 1), r("c", 1)},
+			[]vp.Result[string]{r("a", 0), r("d", 1), r("b", 1)},
+			true,
+		},
+		{
+			[]vp.Result[string]{r("a", 0), r("b", 1)},
+			[]vp.Result[string]{r("a", 0), r("b", 2)},
+			false,
+		},
+		{
+			[]vp.Result[string]{r("a", 1), r("b", 1), r("c", 2)},
+			[]vp.Result[string]{r("a", 1), r("d", 1), r("c", 2)},
+			false,
+		},
+		// Counts must agree.
+		{
+			[]vp.Result[string]{r("a", 0), {Point: "b", Dist: 1, Count: 2}, r("c", 2)},
+			[]vp.Result[string]{r("a", 0), r("b", 1), r("c", 2)},
+			false,
+		},
+	} {
+		if same := sameResults(c.a, c.b); same != c.same {
+			t.Errorf("sameResults(%v, %v) = %t", c.a, c.b, same)
+		}
+	}
+}
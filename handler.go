@@ -2,58 +2,252 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math"
+	"math/big"
+	"math/rand"
 	"net/http"
 	"regexp"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/knaw-huc/levenserv/internal/bktree"
 	"github.com/knaw-huc/levenserv/internal/levenshtein"
 	"github.com/knaw-huc/levenserv/internal/trigrams"
 	"github.com/knaw-huc/levenserv/internal/vp"
 )
 
 type nnIndex struct {
-	debug      bool
-	metricName string
-	metric     vp.Metric
-	normName   string
-	normalize  func(string) string
-	timeout    time.Duration
+	buildWorkers int // Maximum number of goroutines for building the index.
+	debug        bool
+	leafSize     int    // Maximum number of points in a leaf bucket, or zero.
+	flat         bool   // Use vp.Flat instead of vp.StringTree.
+	indexType    string // "vp" (the default), "mvp", "bktree", "linear" or "segmented".
+	metricName   string
+	metric       vp.Metric[string]
+	normName     string
+	normalize    func(string) string
+	segmentSize  int // Size of the mutable segment of a segmented index.
+	shards       int // Number of VP-trees to split the index into, if more than one.
+	timeout      time.Duration
 
-	*vp.Tree
+	index
+}
+
+// An index supports nearest neighbor search in a collection of strings.
+// It is implemented by *vp.StringTree, *vp.Flat, *vp.MVPTree[string],
+// *bktree.Tree[string], *vp.Linear[string], *vp.Sharded[string] and
+// *vp.Segmented[string].
+//
+// Indexes that can be written to snapshots implement io.WriterTo.
+// Indexes that can be modified implement mutableIndex.
+type index interface {
+	Do(func(string) bool)
+	Len() int
+	Range(ctx context.Context, q string, radius float64, pred vp.Predicate[string]) ([]vp.Result[string], error)
+	Search(ctx context.Context, q string, k int, maxDist float64, pred vp.Predicate[string]) ([]vp.Result[string], error)
+	SearchWith(ctx context.Context, q string, k int, maxDist float64, pred vp.Predicate[string], opts vp.Options) ([]vp.Result[string], error)
+}
+
+// A mutableIndex supports insertion and deletion of strings.
+type mutableIndex interface {
+	index
+	Insert(ctx context.Context, s string, ids ...string) error
+	Delete(s string) bool
+}
+
+// A nearestIndex can produce its strings in order of distance from
+// a query, which is needed for paginated results.
+type nearestIndex interface {
+	index
+	Nearest(ctx context.Context, q string) *vp.Iterator[string]
+}
+
+// A batchIndex can search for many queries at once.
+type batchIndex interface {
+	index
+	Join(ctx context.Context, queries []string, k int, maxDist float64, opts vp.Options) ([]vp.Match[string], error)
+}
+
+// A farthestIndex supports farthest neighbor and outlier searches.
+type farthestIndex interface {
+	index
+	Farthest(ctx context.Context, q string, k int) ([]vp.Result[string], error)
+	Outliers(ctx context.Context, threshold float64) ([]vp.Result[string], error)
+}
+
+// A statsIndex can report on its shape.
+type statsIndex interface {
+	index
+	Stats() vp.TreeStats
 }
 
 func (i *nnIndex) init(strs []string) (h http.Handler, err error) {
+	recs := make([]record, len(strs))
+	for j, s := range strs {
+		recs[j].Key = s
+	}
+	return i.initRecords(recs)
+}
+
+// initRecords is like init, but also stores the IDs and data of the records
+// in the index.
+//
+// The index stores the JSON encoding of a record, without its key,
+// as an identifier of the key. Results from searches can then include
+// the identifiers verbatim.
+func (i *nnIndex) initRecords(recs []record) (h http.Handler, err error) {
 	i.metric, err = metricByName(i.metricName)
 	if err != nil {
 		return
 	}
 
+	var (
+		keys   = make([]string, len(recs))
+		ids    = make([]string, len(recs))
+		hasIDs = false
+	)
+	for j, rec := range recs {
+		keys[j] = rec.Key
+		if rec.ID == nil && rec.Data == nil {
+			continue // An empty identifier stands for none.
+		}
+		hasIDs = true
+		if ids[j], err = rec.encodeID(); err != nil {
+			return nil, err
+		}
+	}
+
 	if i.debug {
 		log.Print("building index")
 	}
-	i.Tree, err = vp.New(context.Background(), i.metric, strs)
+	opts := vp.BuildOptions{
+		Seed:     rand.Int63(),
+		Workers:  i.buildWorkers,
+		LeafSize: i.leafSize,
+	}
+	if hasIDs {
+		opts.IDs = ids
+	}
+	i.index, err = i.build(keys, opts)
+	if err != nil {
+		return
+	}
+	if i.debug {
+		log.Printf("done, %d words", i.index.Len())
+	}
+
+	return i.routes(), nil
+}
+
+func (i *nnIndex) build(keys []string, opts vp.BuildOptions) (index, error) {
+	ctx := context.Background()
+	if i.flat && i.indexType != "" && i.indexType != "vp" {
+		return nil, fmt.Errorf("%s index cannot be flat", i.indexType)
+	}
+	if i.shards > 1 {
+		if i.flat || i.indexType != "" && i.indexType != "vp" {
+			return nil, errors.New("only a VP-tree index can be sharded")
+		}
+		return vp.NewSharded(ctx, i.metric, keys, i.shards, opts)
+	}
+
+	switch i.indexType {
+	case "", "vp":
+		t, err := vp.BuildStrings(ctx, i.metric, keys, opts)
+		if err != nil {
+			return nil, err
+		}
+		t.SetNames(i.metricName, i.normName)
+		if i.flat {
+			return t.Flatten(), nil
+		}
+		return t, nil
+	case "mvp":
+		return vp.NewMVP(ctx, i.metric, keys, opts)
+	case "bktree":
+		if !integerMetric(i.metricName) {
+			return nil, fmt.Errorf("bktree index needs an integer-valued metric, not %s",
+				i.metricName)
+		}
+		return bktree.New(ctx, i.metric, keys, opts.IDs)
+	case "linear":
+		return vp.NewLinear(i.metric, keys, opts.IDs), nil
+	case "segmented":
+		return vp.NewSegmented(ctx, i.metric, keys, i.segmentSize, opts)
+	default:
+		return nil, fmt.Errorf("unknown index type %q", i.indexType)
+	}
+}
+
+// load is like init, but reads the index from a snapshot.
+func (i *nnIndex) load(r io.Reader) (h http.Handler, err error) {
+	i.metric, err = metricByName(i.metricName)
+	if err != nil {
+		return
+	}
+
+	if i.debug {
+		log.Print("loading index")
+	}
+	t, _ := vp.NewStrings(context.Background(), i.metric, nil)
+	t.SetNames(i.metricName, i.normName)
+	if _, err = t.ReadFrom(r); err != nil {
+		return
+	}
+	i.index = t
+	if i.debug {
+		log.Printf("done, %d words", i.index.Len())
+	}
+
+	return i.routes(), nil
+}
+
+// loadFlat is like load, but uses the snapshot in b as the storage
+// for a vp.Flat.
+func (i *nnIndex) loadFlat(b []byte) (h http.Handler, err error) {
+	i.metric, err = metricByName(i.metricName)
+	if err != nil {
+		return
+	}
+
+	f, err := vp.LoadFlat(b, i.metric, i.metricName, i.normName)
 	if err != nil {
 		return
 	}
+	i.index = f
 	if i.debug {
-		log.Printf("done, %d words", i.Tree.Len())
+		log.Printf("loaded flat index, %d words", i.index.Len())
 	}
 
+	return i.routes(), nil
+}
+
+func (i *nnIndex) routes() http.Handler {
 	r := httprouter.New()
+	r.GET("/admin/tree", i.treeStats)
+	r.POST("/cluster", i.clusterHandler)
+	r.POST("/delete", i.delete)
 	r.POST("/distance", i.distance)
+	r.POST("/farthest", i.farthest)
 	r.GET("/info", i.info)
+	r.POST("/insert", i.insert)
+	r.POST("/join", i.join)
 	r.GET("/keys", i.allKeys)
 	r.POST("/knn", i.knn)
-	return r, nil
+	r.POST("/medoid", i.medoid)
+	r.POST("/outliers", i.outliers)
+	r.POST("/range", i.rangeSearch)
+	r.POST("/selfjoin", i.selfJoinHandler)
+	return r
 }
 
-func metricByName(name string) (m vp.Metric, err error) {
+func metricByName(name string) (m vp.Metric[string], err error) {
 	switch name {
 	case "jaccard_trigrams":
 		m = trigrams.JaccardDistanceStrings
@@ -75,7 +269,17 @@ func metricByName(name string) (m vp.Metric, err error) {
 	return
 }
 
-// allKeys sends a JSON representation of the set of keys in i.Tree,
+// integerMetric reports whether the metric with the given name only
+// returns integers.
+func integerMetric(name string) bool {
+	switch name {
+	case "levenshtein", "levenshtein_bytes", "levenshtein_damerau":
+		return true
+	}
+	return false
+}
+
+// allKeys sends a JSON representation of the set of keys in i.index,
 // in some unspecified order.
 func (i *nnIndex) allKeys(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	_, err := w.Write([]byte("["))
@@ -84,9 +288,9 @@ func (i *nnIndex) allKeys(w http.ResponseWriter, r *http.Request, _ httprouter.P
 	}
 
 	enc := json.NewEncoder(w)
-	n := i.Tree.Len()
+	n := i.index.Len()
 
-	i.Tree.Do(func(key string) bool {
+	i.index.Do(func(key string) bool {
 		err := enc.Encode(key)
 		if err != nil {
 			return false
@@ -99,6 +303,71 @@ func (i *nnIndex) allKeys(w http.ResponseWriter, r *http.Request, _ httprouter.P
 	})
 }
 
+// insert adds the records in the request body to the index. The body
+// has the same format as the input with -format json.
+func (i *nnIndex) insert(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	idx, ok := i.index.(mutableIndex)
+	if !ok {
+		writeError(w, http.StatusBadRequest, errors.New("index cannot be modified"))
+		return
+	}
+	recs, err := readJSON(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), i.timeout)
+	defer cancel()
+	n := 0
+	for _, rec := range recs {
+		var ids []string
+		if rec.ID != nil || rec.Data != nil {
+			id, err := rec.encodeID()
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			ids = append(ids, id)
+		}
+		if err := idx.Insert(ctx, i.normalizeQuery(rec.Key), ids...); err != nil {
+			writeSearchError(w, err)
+			return
+		}
+		n++
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"inserted": n,
+		"size":     idx.Len(),
+	})
+}
+
+// delete removes the strings in the request body, a JSON list,
+// from the index.
+func (i *nnIndex) delete(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	idx, ok := i.index.(mutableIndex)
+	if !ok {
+		writeError(w, http.StatusBadRequest, errors.New("index cannot be modified"))
+		return
+	}
+	var keys []string
+	if err := json.NewDecoder(r.Body).Decode(&keys); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	n := 0
+	for _, key := range keys {
+		if idx.Delete(i.normalizeQuery(key)) {
+			n++
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"deleted": n,
+		"size":    idx.Len(),
+	})
+}
+
 // distance computes the distance between a pair of input strings,
 // without considering the indexed strings.
 func (i *nnIndex) distance(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
@@ -125,13 +394,29 @@ func (i *nnIndex) distance(w http.ResponseWriter, r *http.Request, _ httprouter.
 
 // info sends some information about the index.
 func (i *nnIndex) info(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	shards := 1
+	if sh, ok := i.index.(*vp.Sharded[string]); ok {
+		shards = sh.Shards()
+	}
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"metric": i.metricName,
 		"norm":   i.normName,
-		"size":   i.Tree.Len(),
+		"shards": shards,
+		"size":   i.index.Len(),
 	})
 }
 
+// treeStats sends statistics about the shape of i.index.
+func (i *nnIndex) treeStats(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	idx, ok := i.index.(statsIndex)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, errors.New(
+			"tree statistics are only available for unsharded, non-flat vp indexes"))
+		return
+	}
+	json.NewEncoder(w).Encode(idx.Stats())
+}
+
 func (i *nnIndex) knn(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	params := defaultParams
 	err := json.NewDecoder(r.Body).Decode(&params)
@@ -142,38 +427,592 @@ func (i *nnIndex) knn(w http.ResponseWriter, r *http.Request, _ httprouter.Param
 		err = errors.New("missing or empty query string")
 	case params.MaxDist < 0:
 		err = fmt.Errorf("negative maximum distance %f", params.MaxDist)
+	case params.Ties != "" && params.Ties != "lexicographic" &&
+		(params.Paginate || params.Cursor != ""):
+		err = errors.New("pages are always in lexicographic order")
+	case params.IncludeTies && (params.Paginate || params.Cursor != ""):
+		err = errors.New("include_ties cannot be combined with pagination")
 	}
 	if err != nil {
 		writeError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	var pred func(string) bool
-	if params.Regexp != "" {
-		re, err := regexp.Compile(params.Regexp)
-		if err != nil {
+	pred, err := compilePredicate(params.Regexp)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	ties, err := parseTies(params.Ties)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	q := i.normalizeQuery(params.Query)
+	if params.Paginate || params.Cursor != "" {
+		idx, ok := i.index.(nearestIndex)
+		if !ok {
+			writeError(w, http.StatusBadRequest,
+				fmt.Errorf("%s index does not support pagination", i.indexType))
+			return
+		}
+		i.knnPage(w, r, idx, q, &params, pred)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), i.timeout)
+	defer cancel()
+	opts := searchOptions(ties, params.IncludeTies)
+	if params.Explain {
+		opts.Stats = new(vp.Stats)
+	}
+	result, err := i.index.SearchWith(ctx, q, params.K, params.MaxDist, pred, opts)
+	complete := err == nil
+	if err != nil && !(params.Partial && err == context.DeadlineExceeded) {
+		writeSearchError(w, err)
+		return
+	}
+
+	if !params.Explain && !params.Partial {
+		json.NewEncoder(w).Encode(toHits(result))
+		return
+	}
+	resp := knnResponse{Results: toHits(result), Stats: opts.Stats}
+	if params.Partial {
+		resp.Complete = &complete
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// knnResponse is sent by /knn instead of a list of results when the client
+// asks for more information.
+type knnResponse struct {
+	Results []hit     `json:"results"`
+	Cursor  string    `json:"cursor,omitempty"`
+	Stats   *vp.Stats `json:"stats,omitempty"`
+
+	// Whether the search finished before the timeout, if the client
+	// accepts partial results.
+	Complete *bool `json:"complete,omitempty"`
+}
+
+// A hit is a search result as sent to the client.
+type hit struct {
+	Dist  float64 `json:"distance"`
+	Point string  `json:"point"`
+	Count int     `json:"count"` // Number of occurrences in the input.
+
+	// The JSON-encoded records for Point, as stored by initRecords.
+	Records []json.RawMessage `json:"records,omitempty"`
+}
+
+func toHits(results []vp.Result[string]) []hit {
+	hits := make([]hit, len(results))
+	for j, r := range results {
+		hits[j] = hit{Dist: r.Dist, Point: r.Point, Count: r.Count}
+		for _, id := range r.IDs {
+			hits[j].Records = append(hits[j].Records, json.RawMessage(id))
+		}
+	}
+	return hits
+}
+
+// knnPage sends a page of k nearest neighbors, starting after params.Cursor,
+// along with a cursor for the next page.
+func (i *nnIndex) knnPage(w http.ResponseWriter, r *http.Request, idx nearestIndex, q string, params *knnParams, pred vp.Predicate[string]) {
+	var after *cursor
+	if params.Cursor != "" {
+		after = new(cursor)
+		if err := after.decode(params.Cursor); err != nil {
 			writeError(w, http.StatusBadRequest, err)
 			return
 		}
-		pred = re.MatchString
+		if after.Query != q {
+			writeError(w, http.StatusBadRequest,
+				errors.New("cursor does not belong to query"))
+			return
+		}
 	}
 
-	ctx, _ := context.WithTimeout(r.Context(), i.timeout)
-	q := params.Query
-	if i.normalize != nil {
-		q = i.normalize(q)
+	ctx, cancel := context.WithTimeout(r.Context(), i.timeout)
+	defer cancel()
+
+	var (
+		it     = idx.Nearest(ctx, q)
+		result = make([]vp.Result[string], 0, params.K)
+		next   string
+	)
+	for len(result) < params.K {
+		res, ok := it.Next()
+		if !ok || res.Dist > params.MaxDist {
+			break
+		}
+		if after.before(res) || pred != nil && !pred(res.Point) {
+			continue
+		}
+		result = append(result, res)
+	}
+	err := it.Err()
+	complete := err == nil
+	if err != nil && !(params.Partial && err == context.DeadlineExceeded) {
+		writeSearchError(w, err)
+		return
+	}
+	// The results of an Iterator come in order, so even after a timeout,
+	// the next page starts after the last of them.
+	if len(result) == params.K && params.K > 0 || !complete && len(result) > 0 {
+		last := result[len(result)-1]
+		next = cursor{Query: q, Dist: last.Dist, Point: last.Point}.encode()
+	}
+
+	resp := knnResponse{Results: toHits(result), Cursor: next}
+	if params.Partial {
+		resp.Complete = &complete
+	}
+	if params.Explain {
+		stats := it.Stats()
+		resp.Stats = &stats
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// A cursor marks the last result on a page of k nearest neighbors.
+// Since Iterators produce results in a fixed order, the next page
+// consists of the results that come after it.
+type cursor struct {
+	Query string  `json:"q"`
+	Dist  float64 `json:"d"`
+	Point string  `json:"p"`
+}
+
+// Reports whether r comes before or at the cursor c, which may be nil.
+func (c *cursor) before(r vp.Result[string]) bool {
+	return c != nil && (r.Dist < c.Dist || r.Dist == c.Dist && r.Point <= c.Point)
+}
+
+func (c cursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (c *cursor) decode(s string) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(b, c)
 	}
-	result, err := i.Tree.Search(ctx, q, params.K, params.MaxDist, pred)
 	if err != nil {
-		status := http.StatusInternalServerError
-		if err == context.DeadlineExceeded {
-			status = http.StatusRequestTimeout
+		err = errors.New("invalid cursor")
+	}
+	return err
+}
+
+// rangeSearch sends all strings within a given distance of the query.
+func (i *nnIndex) rangeSearch(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	params := rangeParams{Radius: -1}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	switch {
+	case params.Radius < 0:
+		err = errors.New("missing or negative radius")
+	case params.Query == "":
+		err = errors.New("missing or empty query string")
+	case params.Limit < 0:
+		err = fmt.Errorf("negative limit %d", params.Limit)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	pred, err := compilePredicate(params.Regexp)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), i.timeout)
+	defer cancel()
+	var (
+		query  = i.normalizeQuery(params.Query)
+		result []vp.Result[string]
+	)
+	if params.Limit > 0 && params.Limit < i.index.Len() {
+		// Search for one more than the limit to see if it is hit. Unlike
+		// Range, this lets the search prune with its k-th distance.
+		result, err = i.index.SearchWith(ctx, query, params.Limit+1,
+			params.Radius, pred, vp.Options{Ties: vp.Lexicographic})
+	} else {
+		result, err = i.index.Range(ctx, query, params.Radius, pred)
+	}
+	if err != nil {
+		writeSearchError(w, err)
+		return
+	}
+
+	truncated := params.Limit > 0 && len(result) > params.Limit
+	if truncated {
+		result = result[:params.Limit]
+	}
+	json.NewEncoder(w).Encode(struct {
+		Results   []hit `json:"results"`
+		Truncated bool  `json:"truncated"`
+	}{
+		toHits(result), truncated,
+	})
+}
+
+// join sends the k nearest neighbors of each of a list of queries.
+func (i *nnIndex) join(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	params := joinParams{K: -1, MaxDist: math.Inf(+1)}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	switch {
+	case params.K < 0:
+		err = errors.New("missing or negative k")
+	case params.MaxDist < 0:
+		err = fmt.Errorf("negative maximum distance %f", params.MaxDist)
+	}
+	for j, q := range params.Queries {
+		if err == nil && q == "" {
+			err = fmt.Errorf("empty query string at index %d", j)
+		}
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	ties, err := parseTies(params.Ties)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	queries := make([]string, len(params.Queries))
+	for j, q := range params.Queries {
+		queries[j] = i.normalizeQuery(q)
+	}
+	opts := searchOptions(ties, params.IncludeTies)
+
+	ctx, cancel := context.WithTimeout(r.Context(), i.timeout)
+	defer cancel()
+	var matches []vp.Match[string]
+	if idx, ok := i.index.(batchIndex); ok {
+		matches, err = idx.Join(ctx, queries, params.K, params.MaxDist, opts)
+	} else {
+		matches = make([]vp.Match[string], len(queries))
+		for j, q := range queries {
+			matches[j].Results, err = i.index.SearchWith(ctx, q, params.K, params.MaxDist, nil, opts)
+			if err != nil {
+				break
+			}
 		}
-		writeError(w, status, err)
+	}
+	if err != nil {
+		writeSearchError(w, err)
+		return
+	}
+	if params.Assign {
+		matches = vp.Assign(matches)
+	}
+
+	out := make([]joinHit, len(matches))
+	for j, m := range matches {
+		out[j] = joinHit{Query: params.Queries[j], Results: toHits(m.Results)}
+	}
+	json.NewEncoder(w).Encode(out)
+}
+
+// A joinHit holds the results for one query of a join.
+type joinHit struct {
+	Query   string `json:"query"`
+	Results []hit  `json:"results"`
+}
+
+// clusterHandler sends the clusters of strings within a given distance of
+// each other.
+func (i *nnIndex) clusterHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	params := clusterParams{Threshold: -1}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	switch {
+	case params.Threshold < 0:
+		err = errors.New("missing or negative threshold")
+	case params.MinSize < 0:
+		err = fmt.Errorf("negative minimum size %d", params.MinSize)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	pred, err := compilePredicate(params.Regexp)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if _, ok := i.index.(clusterIndex); !ok {
+		writeError(w, http.StatusNotImplemented, errNoCluster)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), i.timeout)
+	defer cancel()
+	clusters, err := i.cluster(ctx, params.Threshold, pred, params.MinSize)
+	if err != nil {
+		writeSearchError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(clusters)
+}
+
+// medoid sends the medoid of a list of strings and the distance of each
+// of them to it.
+func (i *nnIndex) medoid(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var posted []string
+	err := json.NewDecoder(r.Body).Decode(&posted)
+	if err == nil && len(posted) == 0 {
+		err = errors.New("empty list of strings")
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	strs := make([]string, len(posted))
+	for j, s := range posted {
+		strs[j] = i.normalizeQuery(s)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), i.timeout)
+	defer cancel()
+	best, dists, err := vp.Medoid(ctx, i.metric, strs)
+	if err != nil {
+		writeSearchError(w, err)
 		return
 	}
 
-	json.NewEncoder(w).Encode(result)
+	out := medoidResponse{
+		Medoid:  posted[best],
+		Members: make([]medoidMember, len(strs)),
+	}
+	for j, s := range posted {
+		out.Members[j] = medoidMember{Point: s, Dist: dists[j]}
+	}
+	json.NewEncoder(w).Encode(out)
+}
+
+type medoidResponse struct {
+	Medoid string `json:"medoid"`
+	// The strings in the order they were posted.
+	Members []medoidMember `json:"members"`
+}
+
+type medoidMember struct {
+	Point string  `json:"point"`
+	Dist  float64 `json:"distance"`
+}
+
+// farthest sends the k strings farthest from the query.
+func (i *nnIndex) farthest(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	params := farthestParams{K: -1}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	switch {
+	case params.K < 0:
+		err = errors.New("missing or negative k")
+	case params.Query == "":
+		err = errors.New("missing or empty query string")
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	idx, ok := i.index.(farthestIndex)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, errors.New(
+			"farthest neighbor search is only available for unsharded, non-flat vp indexes"))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), i.timeout)
+	defer cancel()
+	result, err := idx.Farthest(ctx, i.normalizeQuery(params.Query), params.K)
+	if err != nil {
+		writeSearchError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(toHits(result))
+}
+
+// outliers sends the strings that have no other string within a given
+// distance of them.
+func (i *nnIndex) outliers(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	params := outlierParams{Threshold: -1}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err == nil && params.Threshold < 0 {
+		err = errors.New("missing or negative threshold")
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	idx, ok := i.index.(farthestIndex)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, errors.New(
+			"outlier search is only available for unsharded, non-flat vp indexes"))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), i.timeout)
+	defer cancel()
+	result, err := idx.Outliers(ctx, params.Threshold)
+	if err != nil {
+		writeSearchError(w, err)
+		return
+	}
+
+	// The distance to the nearest other string is infinite if there is
+	// none, which JSON cannot represent; send null instead.
+	type outlier struct {
+		hit
+		Dist *float64 `json:"distance"`
+	}
+	out := make([]outlier, len(result))
+	for j, h := range toHits(result) {
+		out[j].hit = h
+		if !math.IsInf(h.Dist, +1) {
+			out[j].Dist = &result[j].Dist
+		}
+	}
+	json.NewEncoder(w).Encode(out)
+}
+
+// selfJoinHandler streams all pairs of strings within a given distance of
+// each other, as newline-delimited JSON.
+func (i *nnIndex) selfJoinHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	params := selfJoinParams{Threshold: -1}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err == nil && params.Threshold < 0 {
+		err = errors.New("missing or negative threshold")
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if _, ok := i.index.(joinIndex); !ok {
+		writeError(w, http.StatusNotImplemented, errNoJoin)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), i.timeout)
+	defer cancel()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	err = i.selfJoin(ctx, params.Threshold, w)
+	if err != nil {
+		// The status has already been sent, so report the error
+		// in the stream instead.
+		json.NewEncoder(w).Encode(struct {
+			Error string `json:"error"`
+		}{
+			err.Error(),
+		})
+	}
+}
+
+// compilePredicate returns a predicate that matches the regular expression
+// expr, or nil if expr is empty.
+func compilePredicate(expr string) (vp.Predicate[string], error) {
+	if expr == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	return re.MatchString, nil
+}
+
+// searchOptions returns the options for a search with the given ties and
+// include_ties parameters.
+func searchOptions(ties vp.TieBreak, includeTies bool) vp.Options {
+	opts := vp.Options{Ties: ties, IncludeTies: includeTies}
+	if ties == vp.ByID {
+		opts.IDLess = lessID
+	}
+	return opts
+}
+
+// lessID orders the records stored as identifiers by their IDs. Numeric IDs
+// are compared as numbers and come first, then string IDs, compared as
+// strings, then other IDs, compared by their JSON encodings. Records
+// without an ID come last.
+func lessID(a, b string) bool {
+	ka, kb := idKey(a), idKey(b)
+	if ka.kind != kb.kind {
+		return ka.kind < kb.kind
+	}
+	switch ka.kind {
+	case idNumber:
+		return ka.num.Cmp(kb.num) < 0
+	case idNone:
+		return false
+	}
+	return ka.str < kb.str
+}
+
+const (
+	idNumber = iota
+	idString
+	idOther
+	idNone
+)
+
+type recordID struct {
+	kind int
+	num  *big.Float
+	str  string
+}
+
+func idKey(id string) (k recordID) {
+	var rec struct {
+		ID json.RawMessage `json:"id"`
+	}
+	if json.Unmarshal([]byte(id), &rec) != nil || len(rec.ID) == 0 || string(rec.ID) == "null" {
+		return recordID{kind: idNone}
+	}
+	if json.Unmarshal(rec.ID, &k.str) == nil {
+		k.kind = idString
+		return k
+	}
+	if num, ok := new(big.Float).SetString(string(rec.ID)); ok {
+		return recordID{kind: idNumber, num: num}
+	}
+	return recordID{kind: idOther, str: string(rec.ID)}
+}
+
+// parseTies parses the ties parameter of /knn. The default is lexicographic
+// order, so that results are reproducible.
+func parseTies(name string) (vp.TieBreak, error) {
+	switch name {
+	case "", "lexicographic":
+		return vp.Lexicographic, nil
+	case "frequency":
+		return vp.ByFrequency, nil
+	case "id":
+		return vp.ByID, nil
+	}
+	return 0, fmt.Errorf("unknown tie-breaking order %q", name)
+}
+
+func (i *nnIndex) normalizeQuery(q string) string {
+	if i.normalize != nil {
+		q = i.normalize(q)
+	}
+	return q
+}
+
+func writeSearchError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if err == context.DeadlineExceeded {
+		status = http.StatusRequestTimeout
+	}
+	writeError(w, status, err)
 }
 
 func writeError(w http.ResponseWriter, status int, err error) {
@@ -186,13 +1025,78 @@ func writeError(w http.ResponseWriter, status int, err error) {
 }
 
 type knnParams struct {
-	K       int     "json:`k`"
-	MaxDist float64 "json:`maxdist`"
-	Query   string  "json:`query`"
-	Regexp  string  "json:`regexp`"
+	K       int     `json:"k"`
+	MaxDist float64 `json:"maxdist"`
+	Query   string  `json:"query"`
+	Regexp  string  `json:"regexp"`
+
+	// Pagination. If either is set, the response is an object with
+	// the results and a cursor for the next page.
+	Cursor   string `json:"cursor"`
+	Paginate bool   `json:"paginate"`
+
+	// Include search statistics in the response, which is then an object.
+	Explain bool `json:"explain"`
+
+	// On timeout, send the results found so far instead of an error.
+	// The response is then an object that says whether it is complete.
+	Partial bool `json:"partial"`
+
+	// Ranking of points at equal distances: "lexicographic" (the default),
+	// "frequency" for most frequent first or "id" for lowest record first.
+	// Points still tied after that are ranked lexicographically.
+	Ties string `json:"ties"`
+
+	// Return all points at the distance of the k-th result, even if that
+	// makes for more than k results.
+	IncludeTies bool `json:"include_ties"`
 }
 
 var defaultParams = knnParams{
 	K:       -1,           // must be set by caller
 	MaxDist: math.Inf(+1), // find everything
 }
+
+type clusterParams struct {
+	// Maximum distance between linked strings in a cluster.
+	Threshold float64 `json:"threshold"`
+	// Only cluster the strings that match this.
+	Regexp string `json:"regexp"`
+	// Leave out clusters with fewer members.
+	MinSize int `json:"min_size"`
+}
+
+type farthestParams struct {
+	K     int    `json:"k"`
+	Query string `json:"query"`
+}
+
+type outlierParams struct {
+	// Strings with another string within this distance are not outliers.
+	Threshold float64 `json:"threshold"`
+}
+
+type joinParams struct {
+	Queries []string `json:"queries"`
+	K       int      `json:"k"`
+	MaxDist float64  `json:"maxdist"`
+
+	// As for /knn.
+	Ties        string `json:"ties"`
+	IncludeTies bool   `json:"include_ties"`
+
+	// Give each query at most one result, such that no string is the
+	// result for more than one query.
+	Assign bool `json:"assign"`
+}
+
+type selfJoinParams struct {
+	Threshold float64 `json:"threshold"` // Maximum distance within pairs.
+}
+
+type rangeParams struct {
+	Limit  int     `json:"limit"` // Maximum number of results, 0 for no limit.
+	Query  string  `json:"query"`
+	Radius float64 `json:"radius"`
+	Regexp string  `json:"regexp"`
+}
@@ -7,6 +7,7 @@ import (
 	"net/http/httptest"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 )
@@ -41,26 +42,742 @@ func TestInfo(t *testing.T) {
 	if !reflect.DeepEqual(m, map[string]interface{}{
 		"metric": "levenshtein_bytes",
 		"norm":   "nfkd",
+		"shards": 1.,
 		"size":   4.,
 	}) {
 		t.Errorf("unexpected result %v", m)
 	}
 }
 
+func TestSharded(t *testing.T) {
+	idx := nnIndex{metricName: "levenshtein", shards: 3, timeout: time.Second}
+	h, err := idx.init([]string{"foo", "bar", "baz", "quux", "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/info", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	var info map[string]interface{}
+	json.NewDecoder(w.Result().Body).Decode(&info)
+	if info["shards"] != 3. || info["size"] != 4. {
+		t.Errorf("unexpected info %v", info)
+	}
+
+	body := []byte(`{"query": "bax", "k": 1, "ties": "frequency"}`)
+	req = httptest.NewRequest("POST", "/knn", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	var results []result
+	json.NewDecoder(w.Result().Body).Decode(&results)
+	expect := []result{{"point": "bar", "distance": 1., "count": 2.}}
+	if !reflect.DeepEqual(results, expect) {
+		t.Errorf("unexpected result:\n%vwanted:\n%v", results, expect)
+	}
+}
+
 func TestKnnJaccard(t *testing.T) {
 	testKnn(t, "jaccard_trigrams", "brat", 2, []result{
-		{"distance": 0.75, "point": "bar"},
-		{"distance": 0.8461538461538461, "point": "baz"},
+		{"distance": 0.75, "point": "bar", "count": 1.},
+		{"distance": 0.8461538461538461, "point": "baz", "count": 1.},
 	})
 }
 
 func TestKnnLevenshtein(t *testing.T) {
 	testKnn(t, "levenshtein", "foobar", 2, []result{
-		{"point": "bar", "distance": 3.},
-		{"point": "foo", "distance": 3.},
+		{"point": "bar", "distance": 3., "count": 1.},
+		{"point": "foo", "distance": 3., "count": 1.},
 	})
 }
 
+func TestRange(t *testing.T) {
+	h := makeHandler("levenshtein")
+
+	for _, c := range []struct {
+		limit     int
+		expect    []result
+		truncated bool
+	}{
+		{0, []result{
+			{"point": "bar", "distance": 1., "count": 1.},
+			{"point": "baz", "distance": 1., "count": 1.},
+		}, false},
+		{1, []result{{"point": "bar", "distance": 1., "count": 1.}}, true},
+		{2, []result{
+			{"point": "bar", "distance": 1., "count": 1.},
+			{"point": "baz", "distance": 1., "count": 1.},
+		}, false},
+	} {
+		body, _ := json.Marshal(map[string]interface{}{
+			"query": "bax", "radius": 1, "limit": c.limit, "regexp": "^b",
+		})
+		req := httptest.NewRequest("POST", "/range", bytes.NewReader(body))
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		var resp struct {
+			Results   []result
+			Truncated bool
+		}
+		json.NewDecoder(w.Result().Body).Decode(&resp)
+
+		if !reflect.DeepEqual(resp.Results, c.expect) {
+			t.Errorf("unexpected result:\n%vwanted:\n%v", resp.Results, c.expect)
+		}
+		if len(resp.Results) != len(c.expect) || resp.Truncated != c.truncated {
+			t.Errorf("got %d results, truncated = %t, wanted %d, %t",
+				len(resp.Results), resp.Truncated, len(c.expect), c.truncated)
+		}
+	}
+}
+
+func TestKnnPages(t *testing.T) {
+	h := makeHandler("levenshtein")
+
+	var (
+		cursor string
+		points []string
+	)
+	for page := 0; page < 10; page++ {
+		body, _ := json.Marshal(map[string]interface{}{
+			"query": "bax", "k": 1, "paginate": true, "cursor": cursor,
+		})
+		req := httptest.NewRequest("POST", "/knn", bytes.NewReader(body))
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		var resp struct {
+			Results []result
+			Cursor  string
+		}
+		json.NewDecoder(w.Result().Body).Decode(&resp)
+		for _, r := range resp.Results {
+			points = append(points, r["point"].(string))
+		}
+
+		cursor = resp.Cursor
+		if cursor == "" {
+			break
+		}
+	}
+
+	expect := []string{"bar", "baz", "foo", "quux"}
+	if !reflect.DeepEqual(points, expect) {
+		t.Errorf("got %q, wanted %q", points, expect)
+	}
+}
+
+func TestKnnExplain(t *testing.T) {
+	h := makeHandler("levenshtein")
+
+	for _, paginate := range []bool{false, true} {
+		body, _ := json.Marshal(map[string]interface{}{
+			"query": "foobar", "k": 2, "explain": true, "paginate": paginate,
+		})
+		req := httptest.NewRequest("POST", "/knn", bytes.NewReader(body))
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		var resp struct {
+			Results []result
+			Stats   map[string]float64
+		}
+		json.NewDecoder(w.Result().Body).Decode(&resp)
+
+		calls := resp.Stats["distance_calls"]
+		if len(resp.Results) != 2 || calls < 2 || calls > 4 {
+			t.Errorf("unexpected response %v (paginate = %t)", resp, paginate)
+		}
+	}
+}
+
+func TestKnnPartial(t *testing.T) {
+	for _, timeout := range []time.Duration{time.Nanosecond, time.Second} {
+		idx := nnIndex{metricName: "levenshtein", timeout: timeout}
+		h, err := idx.init([]string{"foo", "bar", "baz", "quux"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, paginate := range []bool{false, true} {
+			body, _ := json.Marshal(map[string]interface{}{
+				"query": "bax", "k": 2, "partial": true, "paginate": paginate,
+			})
+			req := httptest.NewRequest("POST", "/knn", bytes.NewReader(body))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			var resp struct {
+				Results  []result
+				Complete *bool
+			}
+			json.NewDecoder(w.Result().Body).Decode(&resp)
+			timedOut := timeout == time.Nanosecond
+			if w.Code != http.StatusOK || resp.Complete == nil || *resp.Complete == timedOut ||
+				!timedOut && len(resp.Results) != 2 {
+				t.Errorf("unexpected response %d, %v (timeout = %v, paginate = %t)",
+					w.Code, resp, timeout, paginate)
+			}
+		}
+
+		body := []byte(`{"query": "bax", "k": 2}`)
+		req := httptest.NewRequest("POST", "/knn", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if timeout == time.Nanosecond && w.Code != http.StatusRequestTimeout {
+			t.Errorf("got status %d without partial, wanted %d",
+				w.Code, http.StatusRequestTimeout)
+		}
+	}
+}
+
+func TestKnnRecords(t *testing.T) {
+	recs, err := readJSON(strings.NewReader(`
+		{"id": 1, "key": "foo", "data": {"lang": "en"}}
+		{"id": "x", "key": "bar"}
+		"baz"
+		{"id": 2, "key": "foo"}
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx := nnIndex{metricName: "levenshtein", timeout: time.Second}
+	h, err := idx.initRecords(recs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := []byte(`{"query": "fo", "k": 1}`)
+	req := httptest.NewRequest("POST", "/knn", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	var results []result
+	json.NewDecoder(w.Result().Body).Decode(&results)
+	expect := []result{{
+		"distance": 1.,
+		"point":    "foo",
+		"count":    2.,
+		"records": []interface{}{
+			map[string]interface{}{
+				"id": 1., "data": map[string]interface{}{"lang": "en"},
+			},
+			map[string]interface{}{"id": 2.},
+		},
+	}}
+	if !reflect.DeepEqual(results, expect) {
+		t.Errorf("unexpected result:\n%vwanted:\n%v", results, expect)
+	}
+}
+
+// Records without an ID must not leave empty identifiers in indexes that
+// keep them per point, such as the BK-tree.
+func TestKnnRecordsBKTree(t *testing.T) {
+	recs, err := readJSON(strings.NewReader(`
+		{"id": 1, "key": "foo"}
+		"fop"
+		{"id": 2, "key": "bar"}
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx := nnIndex{indexType: "bktree", metricName: "levenshtein", timeout: time.Second}
+	h, err := idx.initRecords(recs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := []byte(`{"query": "fo", "k": 2}`)
+	req := httptest.NewRequest("POST", "/knn", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	var results []result
+	if err := json.NewDecoder(w.Result().Body).Decode(&results); err != nil {
+		t.Fatalf("status %d, invalid response: %v", w.Code, err)
+	}
+	expect := []result{
+		{"distance": 1., "point": "foo", "count": 1.,
+			"records": []interface{}{map[string]interface{}{"id": 1.}}},
+		{"distance": 1., "point": "fop", "count": 1.},
+	}
+	if !reflect.DeepEqual(results, expect) {
+		t.Errorf("unexpected result:\n%vwanted:\n%v", results, expect)
+	}
+}
+
+func TestKnnTiesByID(t *testing.T) {
+	recs, err := readJSON(strings.NewReader(`
+		{"id": 10, "key": "bar"}
+		{"id": 9, "key": "baz"}
+		{"id": "a", "key": "bat"}
+		{"key": "bay", "data": 1}
+		"bas"
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := nnIndex{metricName: "levenshtein", timeout: time.Second}
+	h, err := idx.initRecords(recs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := []byte(`{"query": "bax", "k": 5, "ties": "id"}`)
+	req := httptest.NewRequest("POST", "/knn", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	var results []result
+	json.NewDecoder(w.Result().Body).Decode(&results)
+	record := func(r map[string]interface{}) []interface{} {
+		return []interface{}{r}
+	}
+	expect := []result{
+		{"point": "baz", "distance": 1., "count": 1., "records": record(result{"id": 9.})},
+		{"point": "bar", "distance": 1., "count": 1., "records": record(result{"id": 10.})},
+		{"point": "bat", "distance": 1., "count": 1., "records": record(result{"id": "a"})},
+		// Then records without an ID, then strings without records.
+		{"point": "bay", "distance": 1., "count": 1., "records": record(result{"data": 1.})},
+		{"point": "bas", "distance": 1., "count": 1.},
+	}
+	if !reflect.DeepEqual(results, expect) {
+		t.Errorf("unexpected result:\n%vwanted:\n%v", results, expect)
+	}
+}
+
+func TestKnnTies(t *testing.T) {
+	idx := nnIndex{metricName: "levenshtein", timeout: time.Second}
+	h, err := idx.init([]string{"bar", "baz", "foo", "baz", "baz", "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		body   string
+		status int
+		expect []result
+	}{
+		{`{"query": "bax", "k": 1, "ties": "frequency"}`, http.StatusOK,
+			[]result{{"point": "baz", "distance": 1., "count": 3.}}},
+		{`{"query": "bax", "k": 2, "ties": "frequency"}`, http.StatusOK,
+			[]result{
+				{"point": "baz", "distance": 1., "count": 3.},
+				{"point": "bar", "distance": 1., "count": 2.},
+			}},
+		{`{"query": "bax", "k": 1}`, http.StatusOK,
+			[]result{{"point": "bar", "distance": 1., "count": 2.}}},
+		{`{"query": "bax", "k": 1, "include_ties": true}`, http.StatusOK,
+			[]result{
+				{"point": "bar", "distance": 1., "count": 2.},
+				{"point": "baz", "distance": 1., "count": 3.},
+			}},
+		{`{"query": "bax", "k": 1, "ties": "lexicographic", "paginate": true}`,
+			http.StatusOK, nil},
+		{`{"query": "bax", "k": 1, "ties": "alphabet"}`, http.StatusBadRequest, nil},
+		{`{"query": "bax", "k": 1, "ties": "frequency", "paginate": true}`,
+			http.StatusBadRequest, nil},
+		{`{"query": "bax", "k": 1, "include_ties": true, "paginate": true}`,
+			http.StatusBadRequest, nil},
+	} {
+		req := httptest.NewRequest("POST", "/knn", strings.NewReader(c.body))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != c.status {
+			t.Errorf("%s: got status %d, wanted %d", c.body, w.Code, c.status)
+			continue
+		}
+		if c.expect == nil {
+			continue
+		}
+		var results []result
+		json.NewDecoder(w.Result().Body).Decode(&results)
+		if !reflect.DeepEqual(results, c.expect) {
+			t.Errorf("%s: unexpected result:\n%vwanted:\n%v", c.body, results, c.expect)
+		}
+	}
+
+	// Duplicates are stored once.
+	req := httptest.NewRequest("GET", "/info", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	var info map[string]interface{}
+	json.NewDecoder(w.Result().Body).Decode(&info)
+	if info["size"] != 3. {
+		t.Errorf("unexpected size %v, wanted 3", info["size"])
+	}
+}
+
+func TestTreeStats(t *testing.T) {
+	h := makeHandler("levenshtein")
+	req := httptest.NewRequest("GET", "/admin/tree", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	var stats map[string]interface{}
+	json.NewDecoder(w.Result().Body).Decode(&stats)
+	if w.Code != http.StatusOK || stats["points"] != 4. || stats["nodes"] == nil {
+		t.Errorf("unexpected response %d, %v", w.Code, stats)
+	}
+
+	idx := nnIndex{indexType: "linear", metricName: "levenshtein", timeout: time.Second}
+	h, err := idx.init([]string{"foo", "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("unexpected status %d for linear index", w.Code)
+	}
+}
+
+func TestFarthest(t *testing.T) {
+	h := makeHandler("levenshtein")
+
+	for _, c := range []struct {
+		path, body string
+		status     int
+		expect     []result
+	}{
+		{"/farthest", `{"query": "foo", "k": 1}`, http.StatusOK,
+			[]result{{"point": "quux", "distance": 4., "count": 1.}}},
+		{"/farthest", `{"query": "foo"}`, http.StatusBadRequest, nil},
+		{"/outliers", `{"threshold": 1}`, http.StatusOK, []result{
+			{"point": "quux", "distance": 4., "count": 1.},
+			{"point": "foo", "distance": 3., "count": 1.},
+		}},
+		{"/outliers", `{}`, http.StatusBadRequest, nil},
+	} {
+		req := httptest.NewRequest("POST", c.path, strings.NewReader(c.body))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != c.status {
+			t.Errorf("%s %s: got status %d, wanted %d", c.path, c.body, w.Code, c.status)
+			continue
+		}
+		if c.expect == nil {
+			continue
+		}
+		var results []result
+		json.NewDecoder(w.Result().Body).Decode(&results)
+		if !reflect.DeepEqual(results, c.expect) {
+			t.Errorf("%s %s: unexpected result:\n%vwanted:\n%v", c.path, c.body, results, c.expect)
+		}
+	}
+}
+
+func TestJoin(t *testing.T) {
+	for _, typ := range []string{"vp", "linear"} {
+		idx := nnIndex{indexType: typ, metricName: "levenshtein", timeout: time.Second}
+		h, err := idx.init([]string{"foo", "bar", "baz", "quux"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, c := range []struct {
+			body   string
+			status int
+			expect []map[string]interface{}
+		}{
+			{`{"queries": ["bax", "bzr"], "k": 1}`, http.StatusOK,
+				[]map[string]interface{}{
+					{"query": "bax", "results": []interface{}{
+						map[string]interface{}{"point": "bar", "distance": 1., "count": 1.},
+					}},
+					{"query": "bzr", "results": []interface{}{
+						map[string]interface{}{"point": "bar", "distance": 1., "count": 1.},
+					}},
+				}},
+			{`{"queries": ["bar", "bzr"], "k": 1, "assign": true}`, http.StatusOK,
+				[]map[string]interface{}{
+					{"query": "bar", "results": []interface{}{
+						map[string]interface{}{"point": "bar", "distance": 0., "count": 1.},
+					}},
+					{"query": "bzr", "results": []interface{}{}},
+				}},
+			// Matching bax with bar would leave only baz, at distance 2,
+			// for bzr.
+			{`{"queries": ["bax", "bzr"], "k": 2, "assign": true}`, http.StatusOK,
+				[]map[string]interface{}{
+					{"query": "bax", "results": []interface{}{
+						map[string]interface{}{"point": "baz", "distance": 1., "count": 1.},
+					}},
+					{"query": "bzr", "results": []interface{}{
+						map[string]interface{}{"point": "bar", "distance": 1., "count": 1.},
+					}},
+				}},
+			{`{"queries": ["bax"]}`, http.StatusBadRequest, nil},
+			{`{"queries": ["bax", ""], "k": 1}`, http.StatusBadRequest, nil},
+		} {
+			req := httptest.NewRequest("POST", "/join", strings.NewReader(c.body))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if w.Code != c.status {
+				t.Errorf("%s, %s: got status %d, wanted %d", typ, c.body, w.Code, c.status)
+				continue
+			}
+			if c.expect == nil {
+				continue
+			}
+			var got []map[string]interface{}
+			json.NewDecoder(w.Result().Body).Decode(&got)
+			if !reflect.DeepEqual(got, c.expect) {
+				t.Errorf("%s, %s: unexpected result:\n%v\nwanted:\n%v", typ, c.body, got, c.expect)
+			}
+		}
+	}
+}
+
+func TestSelfJoin(t *testing.T) {
+	h := makeHandler("levenshtein")
+
+	body := []byte(`{"threshold": 1}`)
+	req := httptest.NewRequest("POST", "/selfjoin", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	var pairs []map[string]result
+	dec := json.NewDecoder(w.Result().Body)
+	for dec.More() {
+		var p map[string]result
+		if err := dec.Decode(&p); err != nil {
+			t.Fatal(err)
+		}
+		pairs = append(pairs, p)
+	}
+	if len(pairs) != 1 {
+		t.Fatalf("got %d pairs, wanted 1", len(pairs))
+	}
+	a, b := pairs[0]["a"]["point"], pairs[0]["b"]["point"]
+	if !(a == "bar" && b == "baz" || a == "baz" && b == "bar") ||
+		pairs[0]["a"]["distance"] != 1. {
+		t.Errorf("unexpected pair %v", pairs[0])
+	}
+
+	body = []byte(`{}`)
+	req = httptest.NewRequest("POST", "/selfjoin", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d without threshold, wanted %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestCluster(t *testing.T) {
+	h := makeHandler("levenshtein")
+
+	for _, c := range []struct {
+		body   string
+		expect [][]string
+	}{
+		{`{"threshold": 1}`, [][]string{{"bar", "baz"}, {"foo"}, {"quux"}}},
+		{`{"threshold": 1, "min_size": 2}`, [][]string{{"bar", "baz"}}},
+		{`{"threshold": 1, "regexp": "^[fq]"}`, [][]string{{"foo"}, {"quux"}}},
+		{`{"threshold": 3}`, [][]string{{"bar", "baz", "foo"}, {"quux"}}},
+	} {
+		req := httptest.NewRequest("POST", "/cluster", strings.NewReader(c.body))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		var clusters []struct {
+			Medoid  result   `json:"medoid"`
+			Members []result `json:"members"`
+		}
+		if err := json.NewDecoder(w.Result().Body).Decode(&clusters); err != nil {
+			t.Fatal(err)
+		}
+		var got [][]string
+		for _, cl := range clusters {
+			if !reflect.DeepEqual(cl.Medoid, cl.Members[0]) {
+				t.Errorf("%s: medoid %v is not the first member", c.body, cl.Medoid)
+			}
+			var members []string
+			for _, r := range cl.Members {
+				members = append(members, r["point"].(string))
+			}
+			sort.Strings(members)
+			got = append(got, members)
+		}
+		if !reflect.DeepEqual(got, c.expect) {
+			t.Errorf("%s: got clusters %v, wanted %v", c.body, got, c.expect)
+		}
+	}
+
+	for _, body := range []string{`{}`, `{"threshold": 1, "regexp": "("}`} {
+		req := httptest.NewRequest("POST", "/cluster", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("got status %d for %s, wanted %d", w.Code, body, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestMedoid(t *testing.T) {
+	h := makeHandler("levenshtein")
+
+	body := []byte(`["colour", "color", "Colour", "colors"]`)
+	req := httptest.NewRequest("POST", "/medoid", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	var got map[string]interface{}
+	json.NewDecoder(w.Result().Body).Decode(&got)
+	expect := map[string]interface{}{
+		"medoid": "color",
+		"members": []interface{}{
+			map[string]interface{}{"point": "colour", "distance": 1.},
+			map[string]interface{}{"point": "color", "distance": 0.},
+			map[string]interface{}{"point": "Colour", "distance": 2.},
+			map[string]interface{}{"point": "colors", "distance": 1.},
+		},
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("got %v, wanted %v", got, expect)
+	}
+
+	for _, body := range []string{`[]`, `"foo"`} {
+		req := httptest.NewRequest("POST", "/medoid", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("got status %d for %s, wanted %d", w.Code, body, http.StatusBadRequest)
+		}
+	}
+
+	idx := nnIndex{metricName: "levenshtein", timeout: time.Nanosecond}
+	h, err := idx.init([]string{"foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = httptest.NewRequest("POST", "/medoid", strings.NewReader(`["foo", "bar"]`))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestTimeout {
+		t.Errorf("got status %d after timeout, wanted %d", w.Code, http.StatusRequestTimeout)
+	}
+}
+
+func TestIndexTypes(t *testing.T) {
+	for _, typ := range []string{"vp", "mvp", "bktree", "linear", "segmented"} {
+		idx := nnIndex{indexType: typ, metricName: "levenshtein", timeout: time.Second}
+		h, err := idx.init([]string{"foo", "bar", "baz", "quux"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body := []byte(`{"query": "bax", "k": 2}`)
+		req := httptest.NewRequest("POST", "/knn", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		var results []result
+		json.NewDecoder(w.Result().Body).Decode(&results)
+		expect := []result{
+			{"point": "bar", "distance": 1., "count": 1.},
+			{"point": "baz", "distance": 1., "count": 1.},
+		}
+		if !reflect.DeepEqual(results, expect) {
+			t.Errorf("%s: unexpected result:\n%vwanted:\n%v", typ, results, expect)
+		}
+
+		// Only the VP-tree supports pagination.
+		body = []byte(`{"query": "bax", "k": 2, "paginate": true}`)
+		req = httptest.NewRequest("POST", "/knn", bytes.NewReader(body))
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if status := w.Code; (status == http.StatusOK) != (typ == "vp") {
+			t.Errorf("%s: unexpected status %d for paginated request", typ, status)
+		}
+	}
+
+	idx := nnIndex{indexType: "bogus", metricName: "levenshtein"}
+	if _, err := idx.init([]string{"foo"}); err == nil {
+		t.Error("expected error for unknown index type")
+	}
+	idx = nnIndex{indexType: "mvp", metricName: "levenshtein", shards: 2}
+	if _, err := idx.init([]string{"foo"}); err == nil {
+		t.Error("expected error for sharded mvp index")
+	}
+	idx = nnIndex{indexType: "bktree", metricName: "jaccard_trigrams"}
+	if _, err := idx.init([]string{"foo"}); err == nil {
+		t.Error("expected error for bktree with jaccard_trigrams")
+	}
+}
+
+func TestInsertDelete(t *testing.T) {
+	for _, typ := range []string{"vp", "segmented", "mvp"} {
+		idx := nnIndex{
+			indexType:   typ,
+			metricName:  "levenshtein",
+			segmentSize: 2,
+			timeout:     time.Second,
+		}
+		h, err := idx.init([]string{"foo", "bar"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		post := func(path, body string) (int, map[string]interface{}) {
+			req := httptest.NewRequest("POST", path, strings.NewReader(body))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			var resp map[string]interface{}
+			json.NewDecoder(w.Result().Body).Decode(&resp)
+			return w.Code, resp
+		}
+
+		status, resp := post("/insert",
+			`"baz" {"id": 7, "key": "bax"} "quux" "foo" "fooo"`)
+		if typ == "mvp" {
+			if status != http.StatusBadRequest {
+				t.Errorf("mvp: got status %d for insert", status)
+			}
+			continue
+		}
+		if resp["inserted"] != 5. || resp["size"] != 6. {
+			t.Errorf("%s: unexpected response %v", typ, resp)
+		}
+
+		_, resp = post("/delete", `["bar", "nothere", "fooo"]`)
+		if resp["deleted"] != 2. || resp["size"] != 4. {
+			t.Errorf("%s: unexpected response %v", typ, resp)
+		}
+
+		_, resp = post("/range", `{"query": "bar", "radius": 1}`)
+		results := resp["results"].([]interface{})
+		expect := []interface{}{
+			map[string]interface{}{
+				"distance": 1., "point": "bax", "count": 1.,
+				"records": []interface{}{map[string]interface{}{"id": 7.}},
+			},
+			map[string]interface{}{"distance": 1., "point": "baz", "count": 1.},
+		}
+		if len(results) == 2 && results[0].(map[string]interface{})["point"] == "baz" {
+			results[0], results[1] = results[1], results[0]
+		}
+		if !reflect.DeepEqual(results, expect) {
+			t.Errorf("%s: unexpected results:\n%vwanted:\n%v", typ, results, expect)
+		}
+
+		_, resp = post("/knn", `{"query": "foo", "k": 1, "explain": true}`)
+		results = resp["results"].([]interface{})
+		if r := results[0].(map[string]interface{}); r["count"] != 2. {
+			t.Errorf("%s: unexpected result %v", typ, r)
+		}
+	}
+}
+
 // We could decode to []vp.Result, but we'll simulate a client that
 // doesn't share the vp package with us.
 type result map[string]interface{}
@@ -81,17 +798,8 @@ func testKnn(t *testing.T, metric, query string, k int, expect []result) {
 
 	var results []result
 	json.NewDecoder(resp.Body).Decode(&results)
-	sortResults(results)
 
 	if !reflect.DeepEqual(results, expect) {
 		t.Errorf("unexpected result:\n%vwanted:\n%v", results, expect)
 	}
 }
-
-// Sort results by distance first, point second.
-func sortResults(r []result) {
-	sort.Slice(r, func(i, j int) bool {
-		return r[i]["distance"].(float64) < r[j]["distance"].(float64) ||
-			r[i]["point"].(string) < r[j]["point"].(string)
-	})
-}
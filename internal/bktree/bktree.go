@@ -0,0 +1,165 @@
+// Package bktree provides Burkhard-Keller trees (BK-trees), an index
+// structure for metrics that take integer values, such as edit distances.
+//
+// The search methods of a BK-tree have the same semantics as those of
+// vp.Tree. BK-trees do particularly well on queries with a small maximum
+// distance.
+package bktree
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/knaw-huc/levenserv/internal/vp"
+)
+
+// ErrNotInteger is returned by New when the metric returns a distance
+// that is not a non-negative integer.
+var ErrNotInteger = errors.New("bktree: metric returned a non-integer distance")
+
+// A Tree is a BK-tree of items of type T.
+//
+// The methods of a Tree may be called from multiple goroutines
+// concurrently.
+type Tree[T any] struct {
+	metric vp.Metric[T]
+	nelem  int
+	root   *node[T]
+}
+
+type node[T any] struct {
+	point T
+	ids   []string // Identifiers associated with point.
+	count int      // Number of occurrences of point.
+
+	// The children, sorted by their distance to point. The distance from
+	// point to each point in a child subtree is the child's dist.
+	children []child[T]
+}
+
+type child[T any] struct {
+	dist int
+	node *node[T]
+}
+
+// New constructs a Tree from the points, using the metric m, which must
+// only return non-negative integers. If ids is not nil, the identifier
+// ids[i] is associated with points[i], unless it is empty. Points at
+// distance zero from each other are stored only once, with all of their
+// identifiers.
+//
+// Construction may be stopped by canceling ctx, in which case ctx.Err()
+// is returned. If ctx is nil, context.Background() is used.
+//
+// New panics if ids is not nil and has a different length than points.
+func New[T any](ctx context.Context, m vp.Metric[T], points []T, ids []string) (*Tree[T], error) {
+	if ids != nil && len(points) != len(ids) {
+		panic("bktree: number of points and identifiers differ")
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	t := &Tree[T]{metric: m}
+	for i, p := range points {
+		if i%1024 == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		var id []string
+		if ids != nil && ids[i] != "" {
+			id = ids[i : i+1]
+		}
+		if err := t.insert(p, id); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (t *Tree[T]) insert(p T, ids []string) error {
+	if t.root == nil {
+		t.root = &node[T]{point: p, ids: ids, count: 1}
+		t.nelem++
+		return nil
+	}
+
+	n := t.root
+	for {
+		d := t.metric(n.point, p)
+		if d < 0 || d != math.Trunc(d) || math.IsInf(d, 0) {
+			return ErrNotInteger
+		}
+		if d == 0 {
+			n.ids = append(n.ids, ids...)
+			n.count++
+			return nil
+		}
+
+		i := n.search(int(d))
+		if i < len(n.children) && n.children[i].dist == int(d) {
+			n = n.children[i].node
+			continue
+		}
+		n.children = append(n.children, child[T]{})
+		copy(n.children[i+1:], n.children[i:])
+		n.children[i] = child[T]{
+			dist: int(d),
+			node: &node[T]{point: p, ids: ids, count: 1},
+		}
+		t.nelem++
+		return nil
+	}
+}
+
+// Returns the index of the first child of n at distance at least d.
+func (n *node[T]) search(d int) int {
+	return sort.Search(len(n.children), func(i int) bool {
+		return n.children[i].dist >= d
+	})
+}
+
+// Do calls f on each item in the tree t, in some unspecified order,
+// until f returns false.
+func (t *Tree[T]) Do(f func(T) bool) {
+	if t.root != nil {
+		t.root.do(f)
+	}
+}
+
+func (n *node[T]) do(f func(T) bool) bool {
+	if !f(n.point) {
+		return false
+	}
+	for _, c := range n.children {
+		if !c.node.do(f) {
+			return false
+		}
+	}
+	return true
+}
+
+// Len reports the number of distinct elements in t.
+func (t *Tree[T]) Len() int { return t.nelem }
+
+// Search is like vp.Tree.Search.
+func (t *Tree[T]) Search(ctx context.Context, p T, k int, maxDist float64, pred vp.Predicate[T]) ([]vp.Result[T], error) {
+	return t.SearchWith(ctx, p, k, maxDist, pred, vp.Options{})
+}
+
+// SearchWith is like vp.Tree.SearchWith.
+func (t *Tree[T]) SearchWith(ctx context.Context, p T, k int, maxDist float64, pred vp.Predicate[T], opts vp.Options) ([]vp.Result[T], error) {
+	c := vp.NewCollector(ctx, t.metric, p, k, maxDist, pred, opts)
+	search(c, t.root, 0)
+	return c.Finish()
+}
+
+// Range is like vp.Tree.Range.
+func (t *Tree[T]) Range(ctx context.Context, p T, radius float64, pred vp.Predicate[T]) ([]vp.Result[T], error) {
+	c := vp.NewRangeCollector(ctx, t.metric, p, radius, pred)
+	search(c, t.root, 0)
+	return c.Finish()
+}
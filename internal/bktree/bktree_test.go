@@ -0,0 +1,126 @@
+package bktree_test
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/knaw-huc/levenserv/internal/bktree"
+	"github.com/knaw-huc/levenserv/internal/levenshtein"
+	"github.com/knaw-huc/levenserv/internal/trigrams"
+	"github.com/knaw-huc/levenserv/internal/vp"
+	"github.com/stretchr/testify/assert"
+)
+
+func levenshteinDist(a, b string) float64 {
+	return float64(levenshtein.DistanceCodepoints(a, b))
+}
+
+func TestSearch(t *testing.T) {
+	strs := readStrings(t)
+	tree, err := bktree.New(nil, levenshteinDist, strs, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ref, _ := vp.NewFromSeed(nil, levenshteinDist, strs, 1)
+	assert.Equal(t, ref.Len(), tree.Len())
+
+	for i, q := range strs[:200] {
+		q = q + "x"
+		if i%2 == 0 && len(q) > 2 {
+			q = q[1:]
+		}
+
+		for _, maxDist := range []float64{1, 2, math.Inf(+1)} {
+			var stats vp.Stats
+			got, err := tree.SearchWith(nil, q, 5, maxDist, nil, vp.Options{Stats: &stats})
+			expect, _ := ref.Search(nil, q, 5, maxDist, nil)
+			if !assert.NoError(t, err) ||
+				!assert.Equal(t, distances(expect), distances(got), "%q, %g", q, maxDist) {
+				return
+			}
+			if maxDist == 1 {
+				assert.Less(t, stats.DistCalls, len(strs)/2)
+			}
+		}
+
+		got, _ := tree.Range(nil, q, 2, nil)
+		expect, _ := ref.Range(nil, q, 2, nil)
+		assert.Equal(t, distances(expect), distances(got))
+	}
+}
+
+func TestPredicate(t *testing.T) {
+	tree, _ := bktree.New(nil, levenshteinDist,
+		[]string{"foo", "bar", "baz", "bar"}, []string{"1", "2", "3", "4"})
+	assert.Equal(t, 3, tree.Len())
+
+	got, _ := tree.Search(nil, "bax", 1, math.Inf(+1), func(s string) bool {
+		return s != "baz"
+	})
+	assert.Equal(t, []vp.Result[string]{
+		{Dist: 1, Point: "bar", Count: 2, IDs: []string{"2", "4"}},
+	}, got)
+
+	got, _ = tree.SearchWith(nil, "bax", 1, 1, nil, vp.Options{Ties: vp.ByFrequency})
+	assert.Equal(t, "bar", got[0].Point)
+
+	got, _ = tree.SearchWith(nil, "bax", 1, 1, nil, vp.Options{Ties: vp.ByID})
+	assert.Equal(t, "bar", got[0].Point)
+	got, _ = tree.SearchWith(nil, "bax", 1, 1, nil, vp.Options{IncludeTies: true})
+	assert.Len(t, got, 2)
+}
+
+func TestTies(t *testing.T) {
+	strs := readStrings(t)
+	tree, _ := bktree.New(nil, levenshteinDist, strs, nil)
+	ref := vp.NewLinear(levenshteinDist, strs, nil)
+
+	for _, q := range strs[:50] {
+		for _, include := range []bool{false, true} {
+			opts := vp.Options{Ties: vp.Lexicographic, IncludeTies: include}
+			got, _ := tree.SearchWith(nil, q+"x", 3, math.Inf(+1), nil, opts)
+			expect, _ := ref.SearchWith(nil, q+"x", 3, math.Inf(+1), nil, opts)
+			if !assert.Equal(t, expect, got) {
+				return
+			}
+		}
+	}
+}
+
+func TestCancel(t *testing.T) {
+	strs := readStrings(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := bktree.New(ctx, levenshteinDist, strs, nil)
+	assert.Equal(t, context.Canceled, err)
+
+	tree, _ := bktree.New(nil, levenshteinDist, strs, nil)
+	_, err = tree.Search(ctx, "foo", 1, math.Inf(+1), nil)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestNotInteger(t *testing.T) {
+	_, err := bktree.New(nil, trigrams.JaccardDistanceStrings,
+		[]string{"foo", "bar", "baz"}, nil)
+	assert.Equal(t, bktree.ErrNotInteger, err)
+}
+
+func distances(rs []vp.Result[string]) []float64 {
+	d := make([]float64, len(rs))
+	for i, r := range rs {
+		d[i] = r.Dist
+	}
+	return d
+}
+
+func readStrings(t *testing.T) []string {
+	p, err := ioutil.ReadFile("../testdata/strings.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(string(p), "\n")
+}
@@ -0,0 +1,49 @@
+package bktree
+
+import (
+	"math"
+
+	"github.com/knaw-huc/levenserv/internal/vp"
+)
+
+func search[T any](c *vp.Collector[T], n *node[T], depth int) {
+	if n == nil || c.Canceled() {
+		return
+	}
+	c.Visit(depth)
+
+	d := c.Dist(n.point)
+	c.Add(vp.Result[T]{Dist: d, Point: n.point, Count: n.count, IDs: n.ids})
+
+	// By the triangle inequality, only children at distances within
+	// the radius of d can contain results. Visit them from the child at
+	// distance d outwards, since those are likely to have the nearest
+	// points and shrink the radius.
+	var (
+		mid    = n.search(int(d))
+		lo, hi = mid - 1, mid
+	)
+	for lo >= 0 || hi < len(n.children) {
+		var ch *child[T]
+		if hi == len(n.children) ||
+			lo >= 0 && d-float64(n.children[lo].dist) < float64(n.children[hi].dist)-d {
+			ch = &n.children[lo]
+			lo--
+		} else {
+			ch = &n.children[hi]
+			hi++
+		}
+		if math.Abs(float64(ch.dist)-d) > c.Radius() {
+			// Every child farther out is pruned as well.
+			if ch.dist < int(d) {
+				c.Prune(lo + 2)
+				lo = -1
+			} else {
+				c.Prune(len(n.children) - hi + 1)
+				hi = len(n.children)
+			}
+			continue
+		}
+		search(c, ch.node, depth+1)
+	}
+}
@@ -36,6 +36,10 @@ func TestLevenshtein(t *testing.T) {
 			t.Errorf("DistanceCodepoints(%q, %q) = %d; wanted %d",
 				c.a, c.b, d, c.cpDist)
 		}
+		if d := DistanceRunes([]rune(c.a), []rune(c.b)); d != c.cpDist {
+			t.Errorf("DistanceRunes(%q, %q) = %d; wanted %d",
+				c.a, c.b, d, c.cpDist)
+		}
 
 		// Test symmetry.
 		if d := DistanceBytes(c.b, c.a); d != c.byteDist {
@@ -0,0 +1,145 @@
+package vp
+
+import (
+	"container/heap"
+	"math"
+)
+
+// Assign chooses at most one of the results of each match, such that no
+// point is chosen for more than one match. Among the choices, it finds one
+// that gives a result to as many matches as possible, and of those, one
+// with the least total distance. It returns copies of the matches with
+// only the chosen result, if any.
+//
+// Only the results in the matches are considered, so with more results per
+// match, more matches may get one, at a lower total distance.
+func Assign[T comparable](matches []Match[T]) []Match[T] {
+	// Solve this as a minimum cost flow problem on the graph
+	// source -> match -> point -> sink, with unit capacities and
+	// the distances as costs on the edges from matches to points.
+	var (
+		g      flowGraph
+		points = make(map[T]int) // Node numbers.
+		source = len(matches)
+		sink   = source + 1
+	)
+	g.edges = make([][]flowEdge, len(matches)+2)
+	for i, m := range matches {
+		g.addEdge(source, i, 0)
+		for _, r := range m.Results {
+			v, ok := points[r.Point]
+			if !ok {
+				v = len(g.edges)
+				points[r.Point] = v
+				g.edges = append(g.edges, nil)
+				g.addEdge(v, sink, 0)
+			}
+			g.addEdge(i, v, r.Dist)
+		}
+	}
+	g.maxFlow(source, sink)
+
+	assigned := make([]Match[T], len(matches))
+	for i, m := range matches {
+		assigned[i].Query = m.Query
+		// The first edge is the reverse of the one from the source.
+		for j, e := range g.edges[i][1:] {
+			if e.cap == 0 {
+				assigned[i].Results = []Result[T]{m.Results[j]}
+			}
+		}
+	}
+	return assigned
+}
+
+// A flowGraph is a flow network with unit capacities.
+type flowGraph struct {
+	edges [][]flowEdge // Outgoing edges by node.
+}
+
+type flowEdge struct {
+	to   int
+	rev  int // Index of the reverse edge in edges[to].
+	cap  int
+	cost float64
+}
+
+// Adds an edge with capacity one from u to v, and its reverse edge,
+// with capacity zero, from v to u.
+func (g *flowGraph) addEdge(u, v int, cost float64) {
+	g.edges[u] = append(g.edges[u], flowEdge{to: v, rev: len(g.edges[v]), cap: 1, cost: cost})
+	g.edges[v] = append(g.edges[v], flowEdge{to: u, rev: len(g.edges[u]) - 1, cost: -cost})
+}
+
+// Sends the maximum flow from s to t at minimum cost, by successive
+// shortest paths, found by Dijkstra's algorithm with potentials.
+func (g *flowGraph) maxFlow(s, t int) {
+	var (
+		n      = len(g.edges)
+		pot    = make([]float64, n) // All costs are non-negative at first.
+		dist   = make([]float64, n)
+		prev   = make([]int, n) // Node before each node on its shortest path.
+		prevE  = make([]int, n) // Index of the edge in edges[prev[v]].
+		queue  distQueue
+		inf    = math.Inf(+1)
+		active []int
+	)
+	for {
+		for v := range dist {
+			dist[v] = inf
+		}
+		dist[s] = 0
+		queue = append(queue[:0], distItem{s, 0})
+		active = active[:0]
+		for len(queue) > 0 {
+			it := heap.Pop(&queue).(distItem)
+			u := it.node
+			if it.dist > dist[u] {
+				continue
+			}
+			active = append(active, u)
+			for i, e := range g.edges[u] {
+				if e.cap == 0 {
+					continue
+				}
+				// Reduced costs are non-negative, up to rounding.
+				d := dist[u] + math.Max(0, e.cost+pot[u]-pot[e.to])
+				if d < dist[e.to] {
+					dist[e.to] = d
+					prev[e.to], prevE[e.to] = u, i
+					heap.Push(&queue, distItem{e.to, d})
+				}
+			}
+		}
+		if math.IsInf(dist[t], +1) {
+			return
+		}
+		for _, v := range active {
+			pot[v] += dist[v]
+		}
+
+		for v := t; v != s; v = prev[v] {
+			e := &g.edges[prev[v]][prevE[v]]
+			e.cap--
+			g.edges[v][e.rev].cap++
+		}
+	}
+}
+
+type distItem struct {
+	node int
+	dist float64
+}
+
+type distQueue []distItem
+
+func (q distQueue) Len() int            { return len(q) }
+func (q distQueue) Less(i, j int) bool  { return q[i].dist < q[j].dist }
+func (q distQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *distQueue) Push(x interface{}) { *q = append(*q, x.(distItem)) }
+func (q *distQueue) Pop() interface{} {
+	old := *q
+	x := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return x
+}
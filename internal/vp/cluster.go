@@ -0,0 +1,208 @@
+package vp
+
+import (
+	"context"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// A Cluster is a group of points found by Tree.Cluster.
+type Cluster[T any] struct {
+	// The member with the least total distance to the other members,
+	// counting each member as often as it occurs. See Medoid.
+	Medoid Result[T]
+
+	// The members, including the medoid, sorted by their distance to the
+	// medoid, which is stored in their Dist.
+	Members []Result[T]
+}
+
+// Cluster groups the points in t for which pred returns true into
+// single-linkage clusters: two points are in the same cluster if there is
+// a chain of points from one to the other, each within distance threshold
+// of the next. These are the connected components of the graph that links
+// the points within the threshold.
+//
+// The clusters are sorted by number of members, largest first; clusters of
+// equal size are sorted by medoid if the points are strings. The medoids
+// are found as by Medoid, so they are exact for clusters of up to 512
+// distinct points.
+//
+// Cluster does a range search for every point, spread over all CPUs, and
+// holds a read lock on t while it works. It returns an error if and only if
+// the context ctx expires, and then no clusters. If ctx is nil,
+// context.Background() is used instead. If pred is nil, all points are
+// clustered.
+func (t *Tree[T]) Cluster(ctx context.Context, threshold float64, pred Predicate[T]) ([]Cluster[T], error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var (
+		points []joinPoint[T]
+		pos    = make([]int, sizeOf(t.root)) // Index in points by number.
+	)
+	t.root.number(0, func(i int, p *pointDist[T]) {
+		if pred == nil || pred(p.p) {
+			pos[i] = len(points)
+			points = append(points, joinPoint[T]{p, i})
+		}
+	})
+
+	var (
+		j = joiner[T]{
+			metric:    t.metric,
+			pred:      pred,
+			threshold: threshold,
+		}
+		mu    sync.Mutex
+		union = newUnionFind(len(points))
+	)
+	err := forEach(ctx, len(points), func(i int) {
+		j.search(t.root, 0, &points[i], func(_ *pointDist[T], index int, _ float64) {
+			mu.Lock()
+			union.union(i, pos[index])
+			mu.Unlock()
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		clusters []Cluster[T]
+		byRoot   = make(map[int]int) // Index in clusters by root.
+	)
+	for i := range points {
+		root := union.find(i)
+		c, ok := byRoot[root]
+		if !ok {
+			c = len(clusters)
+			byRoot[root] = c
+			clusters = append(clusters, Cluster[T]{})
+		}
+		p := &points[i]
+		clusters[c].Members = append(clusters[c].Members,
+			Result[T]{Point: p.p, Count: p.count, IDs: p.ids})
+	}
+
+	less := lessFunc[T]()
+	err = forEach(ctx, len(clusters), func(i int) {
+		c := &clusters[i]
+		if medoidFirst(ctx, t.metric, less, c.Members) == nil {
+			c.Medoid = c.Members[0]
+		}
+	})
+	if err == nil {
+		err = ctx.Err() // Set if medoidFirst was cut off.
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(clusters, func(i, j int) bool {
+		a, b := &clusters[i], &clusters[j]
+		if len(a.Members) != len(b.Members) {
+			return len(a.Members) > len(b.Members)
+		}
+		return less != nil && less(a.Medoid.Point, b.Medoid.Point)
+	})
+	return clusters, nil
+}
+
+// Moves the medoid of the points to the front, as found by medoid, and
+// sorts the other points by their distance to it. Returns ctx.Err() if
+// ctx expires first.
+func medoidFirst[T any](ctx context.Context, m Metric[T], less func(a, b T) bool, points []Result[T]) error {
+	best, err := medoid(ctx, m, less, points)
+	if err != nil {
+		return err
+	}
+	points[0], points[best] = points[best], points[0]
+
+	rest := points[1:]
+	sort.Slice(rest, func(i, j int) bool {
+		a, b := &rest[i], &rest[j]
+		if a.Dist != b.Dist {
+			return a.Dist < b.Dist
+		}
+		return less != nil && less(a.Point, b.Point)
+	})
+	return nil
+}
+
+// Calls f(i) for each i in [0, n), spread over all CPUs. Returns ctx.Err()
+// if ctx expires before all calls have been made.
+func forEach(ctx context.Context, n int, f func(i int)) error {
+	var (
+		next     int64
+		canceled int32
+		wg       sync.WaitGroup
+	)
+	for w := 0; w < runtime.GOMAXPROCS(0); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1)) - 1
+				if i >= n {
+					return
+				}
+				if ctx.Err() != nil {
+					atomic.StoreInt32(&canceled, 1)
+					return
+				}
+				f(i)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if atomic.LoadInt32(&canceled) != 0 {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// A unionFind is a disjoint-set forest over the integers [0, n).
+type unionFind struct {
+	parent []int
+	rank   []uint8
+}
+
+func newUnionFind(n int) *unionFind {
+	u := &unionFind{parent: make([]int, n), rank: make([]uint8, n)}
+	for i := range u.parent {
+		u.parent[i] = i
+	}
+	return u
+}
+
+// Returns the representative of the set that contains i.
+func (u *unionFind) find(i int) int {
+	for u.parent[i] != i {
+		u.parent[i] = u.parent[u.parent[i]] // Path halving.
+		i = u.parent[i]
+	}
+	return i
+}
+
+// Merges the sets that contain i and j.
+func (u *unionFind) union(i, j int) {
+	i, j = u.find(i), u.find(j)
+	switch {
+	case i == j:
+	case u.rank[i] < u.rank[j]:
+		u.parent[i] = j
+	case u.rank[i] > u.rank[j]:
+		u.parent[j] = i
+	default:
+		u.parent[j] = i
+		u.rank[i]++
+	}
+}
@@ -0,0 +1,71 @@
+package vp
+
+import (
+	"context"
+	"time"
+)
+
+// A Collector collects the results of a search in an index structure
+// outside of this package, with the same semantics as Tree.SearchWith and
+// Tree.Range: it applies the maximum distance, the predicate and the
+// options, and keeps track of the statistics.
+//
+// The index structure calls Dist to compute distances to the query, Add to
+// offer points and Finish to get the results. It can use Radius to prune,
+// since no point farther from the query than Radius will be accepted.
+type Collector[T any] struct {
+	s     *searcher[T]
+	start time.Time
+	stats *Stats
+}
+
+// NewCollector returns a Collector for a search for the k nearest
+// neighbors of p, as by Tree.SearchWith.
+func NewCollector[T any](ctx context.Context, m Metric[T], p T, k int, maxDist float64, pred Predicate[T], opts Options) *Collector[T] {
+	s := newSearcher(ctx, m, p, k, maxDist, pred)
+	s.setOptions(opts)
+	return &Collector[T]{s: s, start: time.Now(), stats: opts.Stats}
+}
+
+// NewRangeCollector returns a Collector for a range search around p,
+// as by Tree.Range.
+func NewRangeCollector[T any](ctx context.Context, m Metric[T], p T, radius float64, pred Predicate[T]) *Collector[T] {
+	s := newSearcher(ctx, m, p, 0, radius, pred)
+	s.unbounded = true
+	return &Collector[T]{s: s, start: time.Now()}
+}
+
+// Dist returns the distance from the query to p.
+func (c *Collector[T]) Dist(p T) float64 { return c.s.dist(p) }
+
+// Radius returns the current search radius.
+func (c *Collector[T]) Radius() float64 { return c.s.radius }
+
+// Add offers r as a result. r.Dist must be the distance from the query
+// to r.Point.
+func (c *Collector[T]) Add(r Result[T]) {
+	if c.s.admits(&r) {
+		c.s.add(r)
+	}
+}
+
+// Canceled reports whether the context of the search has expired.
+// Once it has, the search should stop.
+func (c *Collector[T]) Canceled() bool { return c.s.canceled() }
+
+// Visit records a visit to a node at the given depth for the statistics.
+func (c *Collector[T]) Visit(depth int) { c.s.visit(depth) }
+
+// Prune records n pruned subtrees for the statistics.
+func (c *Collector[T]) Prune(n int) { c.s.stats.Pruned += n }
+
+// Finish returns the results, sorted, and the error from the context if
+// the search was canceled. It stores the statistics in the Stats passed to
+// NewCollector in its options, if any.
+func (c *Collector[T]) Finish() ([]Result[T], error) {
+	c.s.stats.Elapsed = time.Since(c.start)
+	if c.stats != nil {
+		*c.stats = c.s.stats
+	}
+	return c.s.finish()
+}
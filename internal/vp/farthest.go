@@ -0,0 +1,165 @@
+package vp
+
+import (
+	"context"
+	"math"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// Farthest returns the k points in t that are farthest from p, farthest
+// first. Strings at equal distances are sorted lexicographically.
+//
+// Like Search, Farthest returns an error if and only if the context ctx
+// expires, along with the best results found so far.
+// If ctx is nil, context.Background() is used instead.
+func (t *Tree[T]) Farthest(ctx context.Context, p T, k int) ([]Result[T], error) {
+	// The searcher keeps the results with the smallest distances,
+	// so give it the negated distances.
+	s := newSearcher(ctx, t.metric, p, k, math.Inf(+1), nil)
+	s.setOptions(Options{Ties: Lexicographic})
+
+	t.mu.RLock()
+	s.farthest(t.root, 0)
+	t.mu.RUnlock()
+
+	results, err := s.finish()
+	for i := range results {
+		results[i].Dist = -results[i].Dist
+	}
+	return results, err
+}
+
+// Like search, but with negated distances, so that -s.radius is the
+// distance of the k-th farthest point found so far.
+func (s *searcher[T]) farthest(n *node[T], depth int) {
+	if n == nil || s.canceled() {
+		return
+	}
+	s.visit(depth)
+	if n.ndel == n.size {
+		return
+	}
+
+	d := s.dist(n.center)
+	r := Result[T]{Point: n.center, Dist: -d, Count: n.count, IDs: n.ids}
+	if !n.deleted && s.admits(&r) {
+		s.add(r)
+	}
+	for i := range n.bucket {
+		b := &n.bucket[i]
+		if b.deleted {
+			continue
+		}
+		// By the triangle inequality, the distance from the query to the
+		// point is at most d + b.d.
+		if -(d + b.d) > s.radius {
+			s.stats.Skipped++
+			continue
+		}
+		r := Result[T]{Point: b.p, Dist: -s.dist(b.p), Count: b.count, IDs: b.ids}
+		if s.admits(&r) {
+			s.add(r)
+		}
+	}
+
+	// The points outside may be arbitrarily far away, so search them first.
+	// Those inside are at most d + n.radius from the query.
+	s.farthest(n.outside, depth+1)
+	if -(d + n.radius) <= s.radius {
+		s.farthest(n.inside, depth+1)
+	} else if n.inside != nil {
+		s.stats.Pruned++
+	}
+}
+
+// Outliers returns the points in t that have no other point within
+// distance threshold of them, as Results with the distance to the nearest
+// other point, or +Inf if there is none. A point that occurs more than
+// once is never an outlier. The outliers are sorted by distance, farthest
+// first; strings at equal distances are sorted lexicographically.
+//
+// Outliers does a search for every point in t, spread over all CPUs.
+// If the context ctx expires, it returns the outliers found so far,
+// unsorted, along with ctx.Err(). If ctx is nil, context.Background()
+// is used instead.
+func (t *Tree[T]) Outliers(ctx context.Context, threshold float64) ([]Result[T], error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	var points []pointDist[T]
+	t.mu.RLock()
+	t.root.doPoints(func(p *pointDist[T]) bool {
+		if p.count == 1 {
+			points = append(points, *p)
+		}
+		return true
+	})
+	t.mu.RUnlock()
+
+	var (
+		mu       sync.Mutex
+		outliers []Result[T]
+		err      error
+		next     = make(chan *pointDist[T])
+		wg       sync.WaitGroup
+	)
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range next {
+				r, e := t.outlier(ctx, p, threshold)
+				mu.Lock()
+				if e != nil {
+					err = e
+				} else if r != nil {
+					outliers = append(outliers, *r)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range points {
+		if e := ctx.Err(); e != nil {
+			// The workers may not have seen the cancellation.
+			mu.Lock()
+			err = e
+			mu.Unlock()
+			break
+		}
+		next <- &points[i]
+	}
+	close(next)
+	wg.Wait()
+
+	if err != nil {
+		return outliers, err
+	}
+	less := lessFunc[T]()
+	sort.Slice(outliers, func(i, j int) bool {
+		a, b := &outliers[i], &outliers[j]
+		if a.Dist != b.Dist {
+			return a.Dist > b.Dist
+		}
+		return less != nil && less(a.Point, b.Point)
+	})
+	return outliers, nil
+}
+
+// Returns p as an outlier if it has no neighbor within threshold, or nil.
+func (t *Tree[T]) outlier(ctx context.Context, p *pointDist[T], threshold float64) (*Result[T], error) {
+	// p itself is the nearest neighbor, at distance zero.
+	near, err := t.Search(ctx, p.p, 2, math.Inf(+1), nil)
+	if err != nil || len(near) > 1 && near[1].Dist <= threshold {
+		return nil, err
+	}
+
+	r := &Result[T]{Point: p.p, Count: p.count, IDs: p.ids, Dist: math.Inf(+1)}
+	if len(near) > 1 {
+		r.Dist = near[1].Dist
+	}
+	return r, nil
+}
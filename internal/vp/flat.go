@@ -0,0 +1,377 @@
+package vp
+
+import (
+	"context"
+	"time"
+	"unsafe"
+)
+
+// A Flat is an immutable alternative representation of a Tree of strings.
+//
+// Its nodes are stored in a single slice, with child nodes referenced by
+// index, and the centers of all nodes are stored in a single string.
+// This takes less memory than a Tree and contains no pointers for the
+// garbage collector to scan. A Flat can also use a snapshot in memory
+// as its storage, without copying it.
+//
+// The methods of a Flat may be called from multiple goroutines concurrently.
+type Flat struct {
+	metric Metric[string]
+	nodes  []flatNode // Root at index zero.
+	idRefs []idRef    // Identifiers, referenced by nodes.
+	arena  string     // Concatenated centers and identifiers.
+	nelem  int
+	seed   int64
+
+	leafSize int // See BuildOptions.
+
+	metricName, normName string
+}
+
+// A flatNode has the same layout as a node record in a snapshot.
+type flatNode struct {
+	// For a record in a bucket, the distance to the center of its leaf.
+	radius float64
+	offset uint64 // Offset of center in arena.
+	length uint32 // Length of center.
+
+	// Indexes of children. Zero means no child, since the root is nobody's
+	// child. If flags&flagBucket != 0, the node is a leaf and these are
+	// the index of the first record in its bucket and the number of them.
+	inside, outside uint32
+
+	flags uint32
+
+	// Identifiers are idRefs[firstID : firstID+nids].
+	firstID, nids uint32
+
+	count uint64 // Number of occurrences of center.
+}
+
+// An idRef refers to an identifier in the arena of a Flat.
+type idRef struct {
+	offset uint64
+	length uint32
+	_      uint32 // Padding.
+}
+
+func (f *Flat) center(n *flatNode) string {
+	return f.arena[n.offset : n.offset+uint64(n.length)]
+}
+
+// Returns the identifiers associated with n.
+func (f *Flat) ids(n *flatNode) []string {
+	if n.nids == 0 {
+		return nil
+	}
+	ids := make([]string, n.nids)
+	for i, ref := range f.idRefs[n.firstID : n.firstID+n.nids] {
+		ids[i] = f.arena[ref.offset : ref.offset+uint64(ref.length)]
+	}
+	return ids
+}
+
+// Flatten returns a Flat with the same contents and structure as t.
+func (t *StringTree) Flatten() *Flat {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	f := &Flat{
+		metric:     t.metric,
+		nelem:      t.nelem,
+		seed:       t.seed,
+		leafSize:   t.leafSize,
+		metricName: t.metricName,
+		normName:   t.normName,
+	}
+
+	var arena []byte
+	// Appends a record for the point p and returns its index.
+	record := func(p *pointDist[string], radius float64, flags uint32) uint32 {
+		i := uint32(len(f.nodes))
+		f.nodes = append(f.nodes, flatNode{
+			radius:  radius,
+			offset:  uint64(len(arena)),
+			length:  uint32(len(p.p)),
+			flags:   flags,
+			firstID: uint32(len(f.idRefs)),
+			nids:    uint32(len(p.ids)),
+			count:   uint64(p.count),
+		})
+		arena = append(arena, p.p...)
+		for _, id := range p.ids {
+			f.idRefs = append(f.idRefs, idRef{
+				offset: uint64(len(arena)),
+				length: uint32(len(id)),
+			})
+			arena = append(arena, id...)
+		}
+		return i
+	}
+
+	var flatten func(*node[string]) uint32
+	flatten = func(n *node[string]) uint32 {
+		if n == nil {
+			return 0
+		}
+		var flags uint32
+		if n.deleted {
+			flags |= flagDeleted
+		}
+		if len(n.bucket) > 0 {
+			flags |= flagBucket
+		}
+		i := record(&pointDist[string]{p: n.center, ids: n.ids, count: n.count},
+			n.radius, flags)
+
+		if len(n.bucket) > 0 {
+			f.nodes[i].inside = i + 1
+			f.nodes[i].outside = uint32(len(n.bucket))
+			for j := range n.bucket {
+				b := &n.bucket[j]
+				flags := uint32(flagInBucket)
+				if b.deleted {
+					flags |= flagDeleted
+				}
+				record(&b.pointDist, b.d, flags)
+			}
+			return i
+		}
+
+		inside := flatten(n.inside)
+		outside := flatten(n.outside)
+		f.nodes[i].inside, f.nodes[i].outside = inside, outside
+		return i
+	}
+	flatten(t.root)
+	f.arena = string(arena)
+
+	return f
+}
+
+// Converts f back to a pointer-based tree.
+func (f *Flat) unflatten() (root *node[string]) {
+	// Records in buckets do not become nodes. pos maps the indexes of
+	// the other records to those of their nodes.
+	pos := make([]uint32, len(f.nodes))
+	nnodes := uint32(0)
+	for i := range f.nodes {
+		if f.nodes[i].flags&flagInBucket == 0 {
+			pos[i] = nnodes
+			nnodes++
+		}
+	}
+
+	nodes := make([]node[string], nnodes)
+	child := func(j uint32) *node[string] {
+		if j == 0 {
+			return nil
+		}
+		return &nodes[pos[j]]
+	}
+	for i := range f.nodes {
+		fn := &f.nodes[i]
+		if fn.flags&flagInBucket != 0 {
+			continue
+		}
+		n := &nodes[pos[i]]
+		*n = node[string]{
+			center:  f.center(fn),
+			ids:     f.ids(fn),
+			count:   int(fn.count),
+			radius:  fn.radius,
+			deleted: fn.flags&flagDeleted != 0,
+		}
+		if fn.flags&flagBucket != 0 {
+			for _, b := range f.nodes[fn.inside : fn.inside+fn.outside] {
+				n.bucket = append(n.bucket, bucketPoint[string]{
+					pointDist: pointDist[string]{
+						p:     f.center(&b),
+						ids:   f.ids(&b),
+						count: int(b.count),
+						d:     b.radius,
+					},
+					deleted: b.flags&flagDeleted != 0,
+				})
+			}
+		} else {
+			n.inside, n.outside = child(fn.inside), child(fn.outside)
+		}
+	}
+
+	// Children come after their parents, so this loop visits them first.
+	for i := len(nodes) - 1; i >= 0; i-- {
+		n := &nodes[i]
+		n.size = 1 + len(n.bucket) + sizeOf(n.inside) + sizeOf(n.outside)
+		if n.deleted {
+			n.ndel = 1
+		}
+		for _, b := range n.bucket {
+			if b.deleted {
+				n.ndel++
+			}
+		}
+		if n.inside != nil {
+			n.ndel += n.inside.ndel
+		}
+		if n.outside != nil {
+			n.ndel += n.outside.ndel
+		}
+	}
+
+	if len(nodes) > 0 {
+		root = &nodes[0]
+	}
+	return root
+}
+
+// Do calls f on each item in fl, in some unspecified order,
+// until f returns false.
+func (fl *Flat) Do(f func(string) bool) {
+	for i := range fl.nodes {
+		n := &fl.nodes[i]
+		if n.flags&flagDeleted == 0 && !f(fl.center(n)) {
+			return
+		}
+	}
+}
+
+// Len reports the number of elements in f.
+func (f *Flat) Len() int { return f.nelem }
+
+// Search is like Tree.Search.
+func (f *Flat) Search(ctx context.Context, p string, k int, maxDist float64, pred Predicate[string]) ([]Result[string], error) {
+	return f.SearchWith(ctx, p, k, maxDist, pred, Options{})
+}
+
+// SearchWith is like Tree.SearchWith.
+func (f *Flat) SearchWith(ctx context.Context, p string, k int, maxDist float64, pred Predicate[string], opts Options) ([]Result[string], error) {
+	start := time.Now()
+	s := newSearcher(ctx, f.metric, p, k, maxDist, pred)
+	s.setOptions(opts)
+	if len(f.nodes) > 0 {
+		searchFlat(s, f, 0, 0)
+	}
+
+	s.stats.Elapsed = time.Since(start)
+	if opts.Stats != nil {
+		*opts.Stats = s.stats
+	}
+	return s.finish()
+}
+
+// Range is like Tree.Range.
+func (f *Flat) Range(ctx context.Context, p string, radius float64, pred Predicate[string]) ([]Result[string], error) {
+	s := newSearcher(ctx, f.metric, p, 0, radius, pred)
+	s.unbounded = true
+	if len(f.nodes) > 0 {
+		searchFlat(s, f, 0, 0)
+	}
+	return s.finish()
+}
+
+// Like searcher.search, for the subtree of f rooted at index i.
+func searchFlat(s *searcher[string], f *Flat, i uint32, depth int) {
+	if s.canceled() {
+		return
+	}
+	s.visit(depth)
+	n := &f.nodes[i]
+	deleted := n.flags&flagDeleted != 0
+	if deleted && n.inside == 0 && n.outside == 0 {
+		return
+	}
+
+	// Decoding the identifiers allocates, so only do that before
+	// admitting a point if they are needed to rank it.
+	byID := s.result.ties == ByID
+	result := func(n *flatNode) Result[string] {
+		r := Result[string]{Point: f.center(n), Count: int(n.count)}
+		if byID {
+			r.IDs = f.ids(n)
+		}
+		return r
+	}
+	add := func(r Result[string], n *flatNode) {
+		if !byID {
+			r.IDs = f.ids(n)
+		}
+		s.add(r)
+	}
+
+	r := result(n)
+	d := s.dist(r.Point)
+	r.Dist = d
+	if !deleted && s.admits(&r) {
+		add(r, n)
+	}
+	if n.flags&flagBucket != 0 {
+		for j := n.inside; j < n.inside+n.outside; j++ {
+			b := &f.nodes[j]
+			if b.flags&flagDeleted != 0 {
+				continue
+			}
+			if r := result(b); s.scan(&r, b.radius, d) {
+				add(r, b)
+			}
+		}
+		return
+	}
+
+	if d < n.radius {
+		if n.inside != 0 {
+			searchFlat(s, f, n.inside, depth+1)
+		}
+		if n.outside != 0 {
+			if d+s.radius >= n.radius {
+				searchFlat(s, f, n.outside, depth+1)
+			} else {
+				s.stats.Pruned++
+			}
+		}
+	} else {
+		if n.outside != 0 {
+			searchFlat(s, f, n.outside, depth+1)
+		}
+		if n.inside != 0 {
+			if d-s.radius <= n.radius {
+				searchFlat(s, f, n.inside, depth+1)
+			} else {
+				s.stats.Pruned++
+			}
+		}
+	}
+}
+
+// Whether the host byte order and struct layout are those of snapshots,
+// so that the records in a snapshot can be used in place.
+var canCast = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1 &&
+		unsafe.Sizeof(flatNode{}) == flatNodeSize &&
+		unsafe.Sizeof(idRef{}) == idRefSize
+}()
+
+// Returns the n records of type E stored in b, without copying. Reports
+// false if b does not hold exactly n records or is not suitably aligned
+// for E.
+func castSlice[E any](b []byte, n int) ([]E, bool) {
+	var zero E
+	size := int(unsafe.Sizeof(zero))
+	if n < 0 || len(b) != n*size {
+		return nil, false
+	}
+	if n == 0 {
+		return nil, true
+	}
+	p := unsafe.Pointer(&b[0])
+	if uintptr(p)%unsafe.Alignof(zero) != 0 {
+		return nil, false
+	}
+	return unsafe.Slice((*E)(p), n), true
+}
+
+// Returns the bytes in b as a string, without copying.
+func castString(b []byte) string {
+	return *(*string)(unsafe.Pointer(&b))
+}
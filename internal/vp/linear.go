@@ -0,0 +1,125 @@
+package vp
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// A Linear is a brute-force index that compares a query to every point.
+// Its results are exact by construction, which makes it a reference to test
+// other indexes against. For small collections, it is also faster than
+// a Tree, since it spreads each search over runtime.GOMAXPROCS(0)
+// goroutines.
+//
+// The search methods of a Linear call the metric and the predicate from
+// multiple goroutines concurrently. Like those of a Tree, they may be called
+// from multiple goroutines concurrently.
+type Linear[T any] struct {
+	metric Metric[T]
+	points []pointDist[T]
+}
+
+// Searches over fewer points than this per goroutine are not split further.
+const linearChunkSize = 256
+
+// NewLinear returns a Linear for the points, using the metric m.
+// If ids is not nil, the identifier ids[i] is associated with points[i].
+// If T is comparable, equal points are stored only once, with a count
+// of their occurrences and all of their identifiers.
+//
+// NewLinear panics if ids is not nil and has a different length than
+// points.
+func NewLinear[T any](m Metric[T], points []T, ids []string) *Linear[T] {
+	if ids != nil && len(points) != len(ids) {
+		panic("vp: number of points and identifiers differ")
+	}
+	return &Linear[T]{metric: m, points: collapse(points, ids)}
+}
+
+// Do calls f on each item in l, in some unspecified order,
+// until f returns false.
+func (l *Linear[T]) Do(f func(T) bool) {
+	for i := range l.points {
+		if !f(l.points[i].p) {
+			return
+		}
+	}
+}
+
+// Len reports the number of distinct elements in l.
+func (l *Linear[T]) Len() int { return len(l.points) }
+
+// Search is like Tree.Search.
+func (l *Linear[T]) Search(ctx context.Context, p T, k int, maxDist float64, pred Predicate[T]) ([]Result[T], error) {
+	return l.SearchWith(ctx, p, k, maxDist, pred, Options{})
+}
+
+// SearchWith is like Tree.SearchWith.
+func (l *Linear[T]) SearchWith(ctx context.Context, p T, k int, maxDist float64, pred Predicate[T], opts Options) ([]Result[T], error) {
+	start := time.Now()
+	s := newSearcher(ctx, l.metric, p, k, maxDist, pred)
+	s.setOptions(opts)
+	l.search(s)
+
+	s.stats.Elapsed = time.Since(start)
+	if opts.Stats != nil {
+		*opts.Stats = s.stats
+	}
+	return s.finish()
+}
+
+// Range is like Tree.Range.
+func (l *Linear[T]) Range(ctx context.Context, p T, radius float64, pred Predicate[T]) ([]Result[T], error) {
+	s := newSearcher(ctx, l.metric, p, 0, radius, pred)
+	s.unbounded = true
+	l.search(s)
+	return s.finish()
+}
+
+// Scans the points of l in parallel, with a copy of s for each chunk,
+// then merges the results into s.
+func (l *Linear[T]) search(s *searcher[T]) {
+	nchunks := runtime.GOMAXPROCS(0)
+	if n := (len(l.points) + linearChunkSize - 1) / linearChunkSize; n < nchunks {
+		nchunks = n
+	}
+
+	var (
+		parts = make([]searcher[T], nchunks)
+		wg    sync.WaitGroup
+	)
+	points := l.points
+	for i := range parts {
+		size := len(points) / (nchunks - i)
+		chunk := points[:size]
+		points = points[size:]
+
+		parts[i] = *s
+		parts[i].result.results = make([]Result[T], 0, cap(s.result.results))
+		wg.Add(1)
+		go func(s *searcher[T]) {
+			defer wg.Done()
+			s.scanLinear(chunk)
+		}(&parts[i])
+	}
+	wg.Wait()
+
+	for i := range parts {
+		s.merge(&parts[i])
+	}
+}
+
+func (s *searcher[T]) scanLinear(points []pointDist[T]) {
+	for i := range points {
+		if i%linearChunkSize == 0 && s.canceled() {
+			return
+		}
+		p := &points[i]
+		r := Result[T]{Point: p.p, Dist: s.dist(p.p), Count: p.count, IDs: p.ids}
+		if s.admits(&r) {
+			s.add(r)
+		}
+	}
+}
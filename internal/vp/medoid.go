@@ -0,0 +1,154 @@
+package vp
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+
+	"github.com/knaw-huc/levenserv/internal/tinyrng"
+)
+
+const (
+	// Medoid is exact for up to this many points. Above that, it samples
+	// this many points to select candidates.
+	medoidSampleSize = 512
+
+	// Number of candidates whose sum of distances to all points is computed
+	// when sampling.
+	medoidCandidates = 16
+)
+
+// Medoid returns the index in points of their medoid, the point with the
+// least sum of distances to all of the points, and the distance from the
+// medoid to each point. Points that occur more than once in points count
+// as often as they occur. Among points with the same sum, the first string
+// in lexicographic order is chosen, or the first in points for other types.
+// Medoid returns -1 and nil if points is empty.
+//
+// For up to 512 points, Medoid computes the distance between every pair.
+// For more, it estimates the sums from a random sample of the points, then
+// computes the exact sums for the best few candidates in the sample and
+// returns the best of those. This takes time linear in len(points), but
+// may not find the true medoid. The sample is the same for every call,
+// so the result is reproducible.
+//
+// Medoid returns an error if and only if the context ctx expires, and then
+// -1 and nil. If ctx is nil, context.Background() is used instead.
+func Medoid[T any](ctx context.Context, m Metric[T], points []T) (int, []float64, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	results := make([]Result[T], len(points))
+	for i, p := range points {
+		results[i] = Result[T]{Point: p, Count: 1}
+	}
+	best, err := medoid(ctx, m, lessFunc[T](), results)
+	if best < 0 {
+		return -1, nil, err
+	}
+
+	dists := make([]float64, len(results))
+	for i := range results {
+		dists[i] = results[i].Dist
+	}
+	return best, dists, nil
+}
+
+// Returns the index of the medoid of the points, weighted by their counts,
+// and sets the Dist of each point to its distance to the medoid. Among
+// points with the same sum of distances, the first according to less is
+// chosen, if less is not nil. Returns -1 and ctx.Err() if ctx expires.
+func medoid[T any](ctx context.Context, m Metric[T], less func(a, b T) bool, points []Result[T]) (int, error) {
+	if len(points) == 0 {
+		return -1, nil
+	}
+
+	better := func(i, j int, sums []float64) bool {
+		return sums[i] < sums[j] ||
+			sums[i] == sums[j] && less != nil && less(points[i].Point, points[j].Point)
+	}
+
+	var candidates []int
+	if len(points) <= medoidSampleSize {
+		sums := make([]float64, len(points))
+		for i := range points {
+			if ctx.Err() != nil {
+				return -1, ctx.Err()
+			}
+			for j := i + 1; j < len(points); j++ {
+				d := m(points[i].Point, points[j].Point)
+				sums[i] += float64(points[j].Count) * d
+				sums[j] += float64(points[i].Count) * d
+			}
+		}
+		best := 0
+		for i := 1; i < len(points); i++ {
+			if better(i, best, sums) {
+				best = i
+			}
+		}
+		candidates = []int{best}
+	} else {
+		var err error
+		candidates, err = medoidCandidatesOf(ctx, m, points, better)
+		if err != nil {
+			return -1, err
+		}
+	}
+
+	// Compute the exact sums for the candidates, keeping the distances for
+	// the best one. In the exact case, this just fills in the distances.
+	var (
+		best  = -1
+		dists []float64
+		sums  = make([]float64, len(points))
+		tmp   = make([]float64, len(points))
+	)
+	for _, c := range candidates {
+		for i := range points {
+			if i%distChunkSize == 0 && ctx.Err() != nil {
+				return -1, ctx.Err()
+			}
+			tmp[i] = m(points[c].Point, points[i].Point)
+			sums[c] += float64(points[i].Count) * tmp[i]
+		}
+		if best < 0 || better(c, best, sums) {
+			best = c
+			dists, tmp = tmp, dists
+			if tmp == nil {
+				tmp = make([]float64, len(points))
+			}
+		}
+	}
+
+	for i := range points {
+		points[i].Dist = dists[i]
+	}
+	points[best].Dist = 0
+	return best, nil
+}
+
+// Returns the points in a random sample with the least sums of distances
+// to the other points in the sample.
+func medoidCandidatesOf[T any](ctx context.Context, m Metric[T], points []Result[T], better func(i, j int, sums []float64) bool) ([]int, error) {
+	var rng tinyrng.Xoroshiro128
+	rng.Seed(int64(len(points)))
+	perm := rand.New(&rng).Perm(len(points))
+	sample := perm[:medoidSampleSize]
+
+	sums := make([]float64, len(points))
+	for x, i := range sample {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		for _, j := range sample[x+1:] {
+			d := m(points[i].Point, points[j].Point)
+			sums[i] += float64(points[j].Count) * d
+			sums[j] += float64(points[i].Count) * d
+		}
+	}
+	sort.Slice(sample, func(x, y int) bool {
+		return better(sample[x], sample[y], sums)
+	})
+	return sample[:medoidCandidates], nil
+}
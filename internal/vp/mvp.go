@@ -0,0 +1,390 @@
+package vp
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/knaw-huc/levenserv/internal/tinyrng"
+)
+
+// An MVPTree is a multi-vantage-point tree (Bozkaya and Özsoyoğlu, 1999).
+// Each node has two vantage points. The distances to the first split the
+// points of a node into Fanout groups, each of which is split into Fanout
+// groups by the distances to the second. Leaves store the distances from
+// their points to the vantage points on the path from the root, which lets
+// searches skip most of them without computing their distance to the query.
+//
+// An MVPTree typically needs fewer distance computations per query than
+// a Tree, at the cost of slower construction and more memory. It cannot be
+// modified after construction.
+//
+// The methods of an MVPTree may be called from multiple goroutines
+// concurrently.
+type MVPTree[T any] struct {
+	metric Metric[T]
+	nelem  int
+	root   *mvpNode[T]
+}
+
+// Default parameters for MVPTrees.
+const (
+	mvpFanout   = 2
+	mvpLeafSize = 16
+
+	// Maximum number of distances to vantage points on the path from
+	// the root stored for each leaf point.
+	mvpPathLength = 8
+)
+
+type mvpNode[T any] struct {
+	// The vantage points. The second is absent if nvantage < 2.
+	vantage  [2]pointDist[T]
+	nvantage int
+
+	children []mvpChild[T] // For an internal node.
+	points   []mvpPoint[T] // For a leaf.
+}
+
+// An mvpChild is a subtree with the ranges of distances of its points to
+// the vantage points of its parent.
+type mvpChild[T any] struct {
+	lo1, hi1 float64
+	lo2, hi2 float64
+	node     *mvpNode[T]
+}
+
+// An mvpPoint is a point during construction or in a leaf. d1 and d2 are
+// its distances to the vantage points of its node, path those to
+// the vantage points of its ancestors, up to mvpPathLength.
+type mvpPoint[T any] struct {
+	pointDist[T]
+	d1, d2 float64
+	path   []float64
+}
+
+// NewMVP constructs an MVPTree from the points, using the metric m.
+// Of the options, IDs, Seed and Workers are as for Build. LeafSize is the
+// maximum number of points in a leaf besides the vantage points;
+// if it is zero, a default is used. Fanout is the number of groups that
+// each vantage point splits the points of a node into; if it is less than
+// two, a default is used.
+//
+// Construction may be stopped by canceling ctx, in which case ctx.Err()
+// is returned. If ctx is nil, context.Background() is used.
+//
+// NewMVP panics if opts.IDs is not nil and has a different length than
+// points.
+func NewMVP[T any](ctx context.Context, m Metric[T], points []T, opts BuildOptions) (t *MVPTree[T], err error) {
+	if opts.IDs != nil && len(points) != len(opts.IDs) {
+		panic("vp: number of points and identifiers differ")
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if opts.LeafSize <= 0 {
+		opts.LeafSize = mvpLeafSize
+	}
+	if opts.Fanout < 2 {
+		opts.Fanout = mvpFanout
+	}
+
+	collapsed := collapse(points, opts.IDs)
+	b := mvpBuilder[T]{
+		done:     ctx.Done(),
+		metric:   m,
+		points:   make([]mvpPoint[T], len(collapsed)),
+		pool:     newWorkerPool(opts.Workers),
+		fanout:   opts.Fanout,
+		leafSize: opts.LeafSize,
+	}
+	paths := make([]float64, len(collapsed)*mvpPathLength)
+	for i, p := range collapsed {
+		b.points[i] = mvpPoint[T]{
+			pointDist: p,
+			path:      paths[:0:mvpPathLength],
+		}
+		paths = paths[mvpPathLength:]
+	}
+	b.rng.Seed(opts.Seed)
+
+	root := b.build()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	return &MVPTree[T]{metric: m, nelem: len(collapsed), root: root}, nil
+}
+
+type mvpBuilder[T any] struct {
+	done   <-chan struct{}
+	metric Metric[T]
+	points []mvpPoint[T]
+	pool   *workerPool
+	rng    tinyrng.Xoroshiro128
+
+	fanout, leafSize int
+}
+
+func (b *mvpBuilder[T]) build() *mvpNode[T] {
+	select {
+	case <-b.done:
+		return nil
+	default:
+	}
+	if len(b.points) == 0 {
+		return nil
+	}
+
+	n := &mvpNode[T]{}
+
+	// The first vantage point is random, the second is the point
+	// farthest from it.
+	rand.New(&b.rng).Shuffle(len(b.points), b.swap)
+	n.vantage[0] = b.points[0].pointDist
+	b.points = b.points[1:]
+	n.nvantage = 1
+	if len(b.points) == 0 {
+		return n
+	}
+	b.computeDists(n.vantage[0].p, func(p *mvpPoint[T], d float64) { p.d1 = d })
+	far := 0
+	for i := range b.points {
+		if b.points[i].d1 > b.points[far].d1 {
+			far = i
+		}
+	}
+	b.swap(0, far)
+	n.vantage[1] = b.points[0].pointDist
+	b.points = b.points[1:]
+	n.nvantage = 2
+	b.computeDists(n.vantage[1].p, func(p *mvpPoint[T], d float64) { p.d2 = d })
+
+	if len(b.points) <= b.leafSize {
+		n.points = b.points
+		return n
+	}
+
+	for i := range b.points {
+		p := &b.points[i]
+		for _, d := range [2]float64{p.d1, p.d2} {
+			if len(p.path) < cap(p.path) {
+				p.path = append(p.path, d)
+			}
+		}
+	}
+
+	// Split into groups by d1, then each group by d2.
+	var groups [][]mvpPoint[T]
+	sort.Slice(b.points, func(i, j int) bool { return b.points[i].d1 < b.points[j].d1 })
+	for _, g := range b.divide(b.points) {
+		sort.Slice(g, func(i, j int) bool { return g[i].d2 < g[j].d2 })
+		groups = append(groups, b.divide(g)...)
+	}
+
+	n.children = make([]mvpChild[T], len(groups))
+	waits := make([]func(), len(groups))
+	for i, g := range groups {
+		c := &n.children[i]
+		c.lo1, c.hi1 = math.Inf(+1), math.Inf(-1)
+		c.lo2, c.hi2 = math.Inf(+1), math.Inf(-1)
+		for _, p := range g {
+			c.lo1, c.hi1 = math.Min(c.lo1, p.d1), math.Max(c.hi1, p.d1)
+			c.lo2, c.hi2 = math.Min(c.lo2, p.d2), math.Max(c.hi2, p.d2)
+		}
+
+		child := *b
+		child.points = g
+		b.rng.Jump()
+		waits[i] = b.pool.start(func() { c.node = child.build() })
+	}
+	for _, wait := range waits {
+		wait()
+	}
+	return n
+}
+
+// Divides points into at most b.fanout groups of nearly equal size.
+func (b *mvpBuilder[T]) divide(points []mvpPoint[T]) (groups [][]mvpPoint[T]) {
+	for i := b.fanout; i > 0 && len(points) > 0; i-- {
+		size := (len(points) + i - 1) / i
+		groups = append(groups, points[:size])
+		points = points[size:]
+	}
+	return groups
+}
+
+// Calls set on each point with its distance to vantage.
+func (b *mvpBuilder[T]) computeDists(vantage T, set func(*mvpPoint[T], float64)) {
+	var (
+		points = b.points
+		waits  []func()
+	)
+	dists := func(points []mvpPoint[T]) {
+		for i := range points {
+			set(&points[i], b.metric(vantage, points[i].p))
+		}
+	}
+	for len(points) > distChunkSize {
+		chunk := points[:distChunkSize]
+		points = points[distChunkSize:]
+		waits = append(waits, b.pool.start(func() { dists(chunk) }))
+	}
+	dists(points)
+	for _, wait := range waits {
+		wait()
+	}
+}
+
+func (b *mvpBuilder[T]) swap(i, j int) {
+	b.points[i], b.points[j] = b.points[j], b.points[i]
+}
+
+// Do calls f on each item in the tree t, in some unspecified order,
+// until f returns false.
+func (t *MVPTree[T]) Do(f func(T) bool) {
+	t.root.do(f)
+}
+
+func (n *mvpNode[T]) do(f func(T) bool) bool {
+	if n == nil {
+		return true
+	}
+	for i := 0; i < n.nvantage; i++ {
+		if !f(n.vantage[i].p) {
+			return false
+		}
+	}
+	for i := range n.points {
+		if !f(n.points[i].p) {
+			return false
+		}
+	}
+	for i := range n.children {
+		if !n.children[i].node.do(f) {
+			return false
+		}
+	}
+	return true
+}
+
+// Len reports the number of distinct elements in t.
+func (t *MVPTree[T]) Len() int { return t.nelem }
+
+// Search is like Tree.Search.
+func (t *MVPTree[T]) Search(ctx context.Context, p T, k int, maxDist float64, pred Predicate[T]) ([]Result[T], error) {
+	return t.SearchWith(ctx, p, k, maxDist, pred, Options{})
+}
+
+// SearchWith is like Tree.SearchWith.
+func (t *MVPTree[T]) SearchWith(ctx context.Context, p T, k int, maxDist float64, pred Predicate[T], opts Options) ([]Result[T], error) {
+	start := time.Now()
+	s := newSearcher(ctx, t.metric, p, k, maxDist, pred)
+	s.setOptions(opts)
+
+	s.searchMVP(t.root, make([]float64, 0, mvpPathLength), 0)
+
+	s.stats.Elapsed = time.Since(start)
+	if opts.Stats != nil {
+		*opts.Stats = s.stats
+	}
+	return s.finish()
+}
+
+// Range is like Tree.Range.
+func (t *MVPTree[T]) Range(ctx context.Context, p T, radius float64, pred Predicate[T]) ([]Result[T], error) {
+	s := newSearcher(ctx, t.metric, p, 0, radius, pred)
+	s.unbounded = true
+	s.searchMVP(t.root, make([]float64, 0, mvpPathLength), 0)
+	return s.finish()
+}
+
+// path holds the distances from the query to the vantage points of the
+// ancestors of n, as far as they are stored in the leaves. Its capacity
+// is mvpPathLength.
+func (s *searcher[T]) searchMVP(n *mvpNode[T], path []float64, depth int) {
+	if n == nil || s.canceled() {
+		return
+	}
+	s.visit(depth)
+
+	var d [2]float64
+	for i := 0; i < n.nvantage; i++ {
+		v := &n.vantage[i]
+		d[i] = s.dist(v.p)
+		r := Result[T]{Point: v.p, Dist: d[i], Count: v.count, IDs: v.ids}
+		if s.admits(&r) {
+			s.add(r)
+		}
+	}
+
+	for i := range n.points {
+		p := &n.points[i]
+		if s.farFrom(p, d, path) {
+			s.stats.Skipped++
+			continue
+		}
+		r := Result[T]{Point: p.p, Dist: s.dist(p.p), Count: p.count, IDs: p.ids}
+		if s.admits(&r) {
+			s.add(r)
+		}
+	}
+
+	if len(n.children) == 0 {
+		return
+	}
+	for _, x := range d {
+		if len(path) < cap(path) {
+			path = append(path, x)
+		}
+	}
+
+	// Visit the children with the smallest lower bounds on their
+	// distances to the query first, to shrink the radius quickly.
+	var buf [mvpFanout * mvpFanout]mvpBound[T]
+	children := buf[:0]
+	if len(n.children) > len(buf) {
+		children = make([]mvpBound[T], 0, len(n.children)) // Larger fanout.
+	}
+	for i := range n.children {
+		c := &n.children[i]
+		bound := math.Max(math.Max(c.lo1-d[0], d[0]-c.hi1),
+			math.Max(c.lo2-d[1], d[1]-c.hi2))
+		children = append(children, mvpBound[T]{bound, c})
+	}
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].bound < children[j].bound
+	})
+	for i, c := range children {
+		if c.bound > s.radius {
+			s.stats.Pruned += len(children) - i
+			break
+		}
+		s.searchMVP(c.child.node, path, depth+1)
+	}
+}
+
+// A child of an mvpNode with a lower bound on the distance from the query
+// to its points.
+type mvpBound[T any] struct {
+	bound float64
+	child *mvpChild[T]
+}
+
+// Reports whether the leaf point p is farther than s.radius from the query,
+// by the triangle inequality, given the distances d from the query to the
+// vantage points of its node and path to those of its ancestors.
+func (s *searcher[T]) farFrom(p *mvpPoint[T], d [2]float64, path []float64) bool {
+	if math.Abs(d[0]-p.d1) > s.radius || math.Abs(d[1]-p.d2) > s.radius {
+		return true
+	}
+	for i := range p.path {
+		if math.Abs(path[i]-p.path[i]) > s.radius {
+			return true
+		}
+	}
+	return false
+}
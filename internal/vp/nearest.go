@@ -0,0 +1,275 @@
+package vp
+
+import (
+	"container/heap"
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// An Iterator produces the points in a Tree or Flat in order of increasing
+// distance from a query point. Points at equal distances are produced in
+// lexicographic order if they are strings, and in an unspecified order
+// otherwise.
+//
+// An Iterator does only as much work as is needed to produce the points
+// requested from it so far.
+type Iterator[T any] struct {
+	ctx   context.Context
+	err   error
+	query T
+	queue itemQueue[T]
+
+	metric Metric[T]
+	mu     *sync.RWMutex // Lock of the Tree, nil for a Flat.
+	src    nodeSource[T] // The Tree or Flat.
+
+	stats Stats
+}
+
+// A nodeSource is a Tree or a Flat, as seen by an Iterator.
+type nodeSource[T any] interface {
+	// Queues the center and children of the subtree in top.
+	expand(it *Iterator[T], top *item[T])
+	// Returns the identifiers and the count of the point in top.
+	pointInfo(top *item[T]) (ids []string, count int)
+}
+
+// An item in the queue of an Iterator is either a subtree, with a lower
+// bound on the distance of its points to the query, or the center of
+// a node.
+type item[T any] struct {
+	key     float64 // Lower bound or distance.
+	isPoint bool
+	point   T
+	node    *node[T] // For a Tree.
+	slot    int      // For a Tree, 1 + the index of point in node.bucket, or 0.
+	index   uint32   // For a Flat.
+	depth   int
+}
+
+// Nearest returns an Iterator over the points of t, nearest to p first.
+//
+// The Iterator holds a read lock on t while it works, but not between calls
+// to its Next method. If t is modified in between, the Iterator may or may
+// not return points that were inserted or deleted.
+//
+// If ctx is nil, context.Background() is used.
+func (t *Tree[T]) Nearest(ctx context.Context, p T) *Iterator[T] {
+	it := newIterator[T](ctx, t.metric, t.less, p)
+	it.mu, it.src = &t.mu, t
+
+	t.mu.RLock()
+	if t.root != nil {
+		it.queue.items = append(it.queue.items, item[T]{node: t.root})
+	}
+	t.mu.RUnlock()
+
+	return it
+}
+
+// Nearest is like Tree.Nearest.
+func (f *Flat) Nearest(ctx context.Context, p string) *Iterator[string] {
+	it := newIterator(ctx, f.metric, stringLess, p)
+	it.src = f
+	if len(f.nodes) > 0 {
+		it.queue.items = append(it.queue.items, item[string]{index: 0})
+	}
+	return it
+}
+
+func newIterator[T any](ctx context.Context, m Metric[T], less func(a, b T) bool, p T) *Iterator[T] {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &Iterator[T]{
+		ctx:    ctx,
+		metric: m,
+		query:  p,
+		queue:  itemQueue[T]{less: less},
+	}
+}
+
+// Next returns the next nearest point. Its second return value is false
+// when there are no more points, or when the context of it has expired.
+func (it *Iterator[T]) Next() (Result[T], bool) {
+	start := time.Now()
+	defer func() { it.stats.Elapsed += time.Since(start) }()
+
+	if it.mu != nil {
+		it.mu.RLock()
+		defer it.mu.RUnlock()
+	}
+
+	for it.queue.Len() > 0 {
+		select {
+		case <-it.ctx.Done():
+			it.err = it.ctx.Err()
+			it.queue.items = nil
+			return Result[T]{}, false
+		default:
+		}
+
+		top := heap.Pop(&it.queue).(item[T])
+		if top.isPoint {
+			r := Result[T]{Point: top.point, Dist: top.key}
+			r.IDs, r.Count = it.src.pointInfo(&top)
+			return r, true
+		}
+		it.stats.Visited++
+		if top.depth > it.stats.MaxDepth {
+			it.stats.MaxDepth = top.depth
+		}
+		it.src.expand(it, &top)
+	}
+	return Result[T]{}, false
+}
+
+// Err returns the error that stopped it, if any. This is ctx.Err() for the
+// context passed to Nearest.
+func (it *Iterator[T]) Err() error { return it.err }
+
+// Stats returns statistics about the work done by it so far.
+// Subtrees that are still queued are counted as pruned.
+func (it *Iterator[T]) Stats() Stats {
+	stats := it.stats
+	for i := range it.queue.items {
+		if !it.queue.items[i].isPoint {
+			stats.Pruned++
+		}
+	}
+	return stats
+}
+
+// expand and pointInfo implement nodeSource.
+func (t *Tree[T]) expand(it *Iterator[T], top *item[T]) {
+	n := top.node
+	d := it.dist(n.center)
+	if !n.deleted {
+		heap.Push(&it.queue, item[T]{key: d, isPoint: true, point: n.center, node: n})
+	}
+	for i := range n.bucket {
+		if b := &n.bucket[i]; !b.deleted {
+			heap.Push(&it.queue, item[T]{
+				key: it.dist(b.p), isPoint: true, point: b.p, node: n, slot: i + 1,
+			})
+		}
+	}
+	if n.inside != nil {
+		heap.Push(&it.queue, item[T]{
+			key:   insideBound(top.key, d, n.radius),
+			node:  n.inside,
+			depth: top.depth + 1,
+		})
+	}
+	if n.outside != nil {
+		heap.Push(&it.queue, item[T]{
+			key:   outsideBound(top.key, d, n.radius),
+			node:  n.outside,
+			depth: top.depth + 1,
+		})
+	}
+}
+
+func (t *Tree[T]) pointInfo(top *item[T]) ([]string, int) {
+	if top.slot > 0 {
+		b := &top.node.bucket[top.slot-1]
+		return b.ids, b.count
+	}
+	return top.node.ids, top.node.count
+}
+
+// expand and pointInfo implement nodeSource.
+func (f *Flat) expand(it *Iterator[string], top *item[string]) {
+	n := &f.nodes[top.index]
+	center := f.center(n)
+	d := it.dist(center)
+	if n.flags&flagDeleted == 0 {
+		heap.Push(&it.queue, item[string]{
+			key: d, isPoint: true, point: center, index: top.index,
+		})
+	}
+	if n.flags&flagBucket != 0 {
+		for j := n.inside; j < n.inside+n.outside; j++ {
+			if b := &f.nodes[j]; b.flags&flagDeleted == 0 {
+				p := f.center(b)
+				heap.Push(&it.queue, item[string]{
+					key: it.dist(p), isPoint: true, point: p, index: j,
+				})
+			}
+		}
+		return
+	}
+	if n.inside != 0 {
+		heap.Push(&it.queue, item[string]{
+			key:   insideBound(top.key, d, n.radius),
+			index: n.inside,
+			depth: top.depth + 1,
+		})
+	}
+	if n.outside != 0 {
+		heap.Push(&it.queue, item[string]{
+			key:   outsideBound(top.key, d, n.radius),
+			index: n.outside,
+			depth: top.depth + 1,
+		})
+	}
+}
+
+func (f *Flat) pointInfo(top *item[string]) ([]string, int) {
+	n := &f.nodes[top.index]
+	return f.ids(n), int(n.count)
+}
+
+func (it *Iterator[T]) dist(p T) float64 {
+	it.stats.DistCalls++
+	return it.metric(it.query, p)
+}
+
+// Lower bounds on the distance from the query to points inside and
+// outside of a node, given a bound for the node itself and the distance
+// d from the query to its center, by the triangle inequality.
+func insideBound(bound, d, radius float64) float64 {
+	return math.Max(bound, d-radius)
+}
+
+func outsideBound(bound, d, radius float64) float64 {
+	return math.Max(bound, radius-d)
+}
+
+// itemQueue is a min-heap of items. Subtrees come before points with the
+// same key, so that all points at a given distance have been queued by the
+// time the first of them is popped. They then come out in the order given
+// by less, if it is not nil.
+type itemQueue[T any] struct {
+	items []item[T]
+	less  func(a, b T) bool
+}
+
+func (q *itemQueue[T]) Len() int { return len(q.items) }
+
+func (q *itemQueue[T]) Less(i, j int) bool {
+	a, b := &q.items[i], &q.items[j]
+	switch {
+	case a.key != b.key:
+		return a.key < b.key
+	case a.isPoint != b.isPoint:
+		return !a.isPoint
+	default:
+		return q.less != nil && q.less(a.point, b.point)
+	}
+}
+
+func (q *itemQueue[T]) Swap(i, j int) { q.items[i], q.items[j] = q.items[j], q.items[i] }
+
+func (q *itemQueue[T]) Push(x interface{}) { q.items = append(q.items, x.(item[T])) }
+
+func (q *itemQueue[T]) Pop() interface{} {
+	old := q.items
+	x := old[len(old)-1]
+	q.items = old[:len(old)-1]
+	return x
+}
+
+func stringLess(a, b string) bool { return a < b }
@@ -6,6 +6,9 @@ import (
 	"context"
 	"math"
 	"math/rand"
+	"reflect"
+	"runtime"
+	"unsafe"
 
 	"github.com/knaw-huc/levenserv/internal/tinyrng"
 )
@@ -15,70 +18,252 @@ import (
 // Construction may be stopped by canceling ctx,
 // in which case ctx.Err() is returned.
 // Otherwise, err will be nil. If ctx is nil, context.Background() is used.
-func New(ctx context.Context, m Metric, points []string) (t *Tree, err error) {
+func New[T any](ctx context.Context, m Metric[T], points []T) (t *Tree[T], err error) {
 	return NewFromSeed(ctx, m, points, rand.Int63())
 }
 
 // NewFrom is like New, but with an explicit random seed.
-func NewFromSeed(ctx context.Context, m Metric, points []string, seed int64) (t *Tree, err error) {
+//
+// If T is comparable, equal points are stored only once, with a count of
+// their occurrences. Otherwise, each point is stored separately.
+func NewFromSeed[T any](ctx context.Context, m Metric[T], points []T, seed int64) (t *Tree[T], err error) {
+	return Build(ctx, m, points, BuildOptions{Seed: seed})
+}
+
+// NewWithIDs is like NewFromSeed, but associates the identifier ids[i]
+// with points[i]. Equal points are stored only once, with all of their
+// identifiers. The identifiers are opaque to the Tree, except that an
+// empty ids[i] means that points[i] has no identifier.
+//
+// NewWithIDs panics if points and ids have different lengths.
+func NewWithIDs[T comparable](ctx context.Context, m Metric[T], points []T, ids []string, seed int64) (t *Tree[T], err error) {
+	return Build(ctx, m, points, BuildOptions{IDs: ids, Seed: seed})
+}
+
+// BuildOptions are optional parameters for Build.
+type BuildOptions struct {
+	// If IDs is not nil, IDs[i] is associated with points[i],
+	// as by NewWithIDs.
+	IDs []string
+
+	// Seed for the random choices made during construction.
+	Seed int64
+
+	// Maximum number of goroutines that construct the tree.
+	// If Workers is zero, runtime.GOMAXPROCS(0) is used.
+	// The tree does not depend on Workers, only on Seed.
+	Workers int
+
+	// If LeafSize is positive, subtrees of up to LeafSize+1 points are
+	// stored as a single leaf: a vantage point plus a bucket of the other
+	// points, with their distances to the vantage point. Searches scan
+	// a bucket linearly and use those distances to skip points that
+	// cannot be near enough to the query.
+	LeafSize int
+
+	// Fanout is only used by NewMVP.
+	Fanout int
+}
+
+// Build constructs a Tree from the points, using the metric m.
+// It is like NewFromSeed, but takes additional options.
+//
+// Build panics if opts.IDs is not nil and has a different length than points.
+func Build[T any](ctx context.Context, m Metric[T], points []T, opts BuildOptions) (t *Tree[T], err error) {
+	if opts.IDs != nil && len(points) != len(opts.IDs) {
+		panic("vp: number of points and identifiers differ")
+	}
+	return newTree(ctx, m, collapse(points, opts.IDs), opts, newWorkerPool(opts.Workers))
+}
+
+// Collapses equal points into a single pointDist each, with the number of
+// occurrences and the non-empty identifiers ids[i] of the occurrences
+// points[i], if ids is not nil. Points are only collapsed if T is
+// comparable.
+func collapse[T any](points []T, ids []string) []pointDist[T] {
+	var (
+		pointsDists = make([]pointDist[T], 0, len(points))
+		find        func(p T, next int) int // Index of p, or next if p is new.
+	)
+	switch typ := reflect.TypeOf((*T)(nil)).Elem(); {
+	case typ.Kind() == reflect.String:
+		// Strings are by far the most common case, so avoid boxing them.
+		index := make(map[string]int)
+		find = func(p T, next int) int {
+			s := *(*string)(unsafe.Pointer(&p))
+			if j, ok := index[s]; ok {
+				return j
+			}
+			index[s] = next
+			return next
+		}
+	case typ.Comparable():
+		// A type can be comparable while some of its values cannot be
+		// hashed, such as an interface holding a slice. Such points are
+		// never collapsed.
+		check := holdsInterface(typ)
+		index := make(map[interface{}]int)
+		find = func(p T, next int) int {
+			var key interface{} = p
+			if check && !hashable(reflect.ValueOf(key)) {
+				return next
+			}
+			if j, ok := index[key]; ok {
+				return j
+			}
+			index[key] = next
+			return next
+		}
+	default:
+		find = func(_ T, next int) int { return next }
+	}
+
+	for i, p := range points {
+		j := find(p, len(pointsDists))
+		if j == len(pointsDists) {
+			pointsDists = append(pointsDists, pointDist[T]{p: p})
+		}
+		pointsDists[j].count++
+		if ids != nil && ids[i] != "" {
+			pointsDists[j].ids = append(pointsDists[j].ids, ids[i])
+		}
+	}
+	return pointsDists
+}
+
+// Reports whether values of the comparable type typ can hold an interface
+// value, whose dynamic type may not be comparable.
+func holdsInterface(typ reflect.Type) bool {
+	switch typ.Kind() {
+	case reflect.Interface:
+		return true
+	case reflect.Array:
+		return holdsInterface(typ.Elem())
+	case reflect.Struct:
+		for i := 0; i < typ.NumField(); i++ {
+			if holdsInterface(typ.Field(i).Type) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Reports whether v can be used as a map key.
+func hashable(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Invalid:
+		return true // nil interface.
+	case reflect.Interface:
+		return hashable(v.Elem())
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if !hashable(v.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !hashable(v.Field(i)) {
+				return false
+			}
+		}
+		return true
+	}
+	return v.Type().Comparable()
+}
+
+// Constructs a Tree, using goroutines from pool.
+func newTree[T any](ctx context.Context, m Metric[T], points []pointDist[T], opts BuildOptions, pool *workerPool) (t *Tree[T], err error) {
 	if ctx == nil {
 		ctx = context.Background()
 	}
 	done := ctx.Done()
 
-	var pointsDists []pointDist
-	for _, p := range points {
-		pointsDists = append(pointsDists, pointDist{p: p})
-	}
-
-	b := builder{
-		done:   done,
-		metric: m,
-		points: pointsDists,
+	b := builder[T]{
+		done:     done,
+		metric:   m,
+		points:   points,
+		pool:     pool,
+		leafSize: opts.LeafSize,
 	}
-	b.rng.Seed(seed)
+	b.rng.Seed(opts.Seed)
 
 	root := b.build()
 	select {
 	case <-done:
 		err = ctx.Err()
 	default:
-		t = &Tree{
-			metric: m,
-			nelem:  len(points),
-			root:   root,
+		t = &Tree[T]{
+			metric:   m,
+			less:     lessFunc[T](),
+			nelem:    len(points),
+			root:     root,
+			rng:      b.rng,
+			seed:     opts.Seed,
+			workers:  opts.Workers,
+			leafSize: opts.LeafSize,
 		}
+		t.rng.Jump()
 	}
 	return
 }
 
-type builder struct {
+// rebuild constructs a new subtree from the points in the subtree rooted
+// at n that have not been deleted, plus the points in extra.
+//
+// The caller must hold t.mu for writing.
+func (t *Tree[T]) rebuild(n *node[T], extra ...pointDist[T]) *node[T] {
+	points := extra
+	n.doPoints(func(p *pointDist[T]) bool {
+		points = append(points, *p)
+		return true
+	})
+
+	b := builder[T]{
+		metric:   t.metric,
+		points:   points,
+		pool:     newWorkerPool(t.workers),
+		leafSize: t.leafSize,
+		rng:      t.rng,
+	}
+	t.rng.Jump()
+	return b.build()
+}
+
+type builder[T any] struct {
 	done   <-chan struct{}
-	metric Metric
-	points []pointDist          // Points, with scratch space for distances.
+	metric Metric[T]
+	points []pointDist[T]       // Points, with scratch space for distances.
+	pool   *workerPool          // Shared by all builders for a tree.
 	rng    tinyrng.Xoroshiro128 // Splittable RNG.
+
+	leafSize int // See BuildOptions.
 }
 
-type pointDist struct {
-	p string
-	d float64
+type pointDist[T any] struct {
+	p     T
+	ids   []string
+	count int // Number of occurrences of p.
+	d     float64
 }
 
-func (b *builder) build() *node {
+func (b *builder[T]) build() *node[T] {
 	select {
 	case <-b.done:
 		return nil // don't care; New is going to ignore the result
 	default:
 	}
 
-	switch len(b.points) {
-	case 0:
+	switch n := len(b.points); {
+	case n == 0:
 		return nil
-	case 1:
-		return singleton(b.points[0].p, &node{})
-	case 2:
+	case n <= b.leafSize+1:
+		return b.buildLeaf() // Also handles single points.
+	case n == 2:
 		return b.build2()
-	case 3:
+	case n == 3:
 		return b.build3()
 	}
 
@@ -86,67 +271,167 @@ func (b *builder) build() *node {
 	rand.New(&b.rng).Shuffle(len(b.points), b.swap)
 
 	vantage := b.selectVantage()
-	// XXX the following loop can be done in parallel.
-	for i := range b.points {
-		b.points[i].d = b.metric(vantage, b.points[i].p)
-	}
+	b.computeDists(vantage.p)
 	medianIdx := b.selectMedian()
 	medianDist := b.points[medianIdx].d
 
 	left, right := b, b.split(medianIdx)
-	inside := make(chan *node, 1)
+	var inside *node[T]
+	wait := b.pool.start(func() { inside = left.build() })
+	outside := right.build()
+	wait()
+
+	n := &node[T]{
+		center:  vantage.p,
+		ids:     vantage.ids,
+		count:   vantage.count,
+		inside:  inside,
+		outside: outside,
+		radius:  medianDist,
+	}
+	n.size = 1 + sizeOf(n.inside) + sizeOf(n.outside)
+	return n
+}
+
+// Loops over more points than this are split into chunks that are
+// processed by separate workers.
+const distChunkSize = 1024
+
+// Sets b.points[...].d to the distances to vantage.
+func (b *builder[T]) computeDists(vantage T) {
+	var (
+		points = b.points
+		waits  []func()
+	)
+	for len(points) > distChunkSize {
+		chunk := points[:distChunkSize]
+		points = points[distChunkSize:]
+		waits = append(waits, b.pool.start(func() {
+			b.dists(vantage, chunk)
+		}))
+	}
+	b.dists(vantage, points)
+	for _, wait := range waits {
+		wait()
+	}
+}
+
+func (b *builder[T]) dists(vantage T, points []pointDist[T]) {
+	for i := range points {
+		points[i].d = b.metric(vantage, points[i].p)
+	}
+}
+
+// A workerPool limits the number of goroutines used by the builders
+// for a tree.
+type workerPool struct {
+	tokens chan struct{} // One for each goroutine besides the first.
+}
+
+// Returns a pool for n goroutines, or runtime.GOMAXPROCS(0) if n is zero.
+func newWorkerPool(n int) *workerPool {
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	return &workerPool{tokens: make(chan struct{}, n-1)}
+}
+
+// Runs f in a new goroutine if the pool has room for one, else in the
+// calling goroutine. The returned function waits for f to finish.
+func (p *workerPool) start(f func()) (wait func()) {
+	select {
+	case p.tokens <- struct{}{}:
+	default:
+		f()
+		return func() {}
+	}
+
+	done := make(chan struct{})
 	go func() {
-		inside <- left.build()
+		defer func() {
+			<-p.tokens
+			close(done)
+		}()
+		f()
 	}()
+	return func() { <-done }
+}
 
-	return &node{
-		center:  vantage,
-		inside:  <-inside,
-		outside: right.build(),
-		radius:  medianDist,
+// Base case for a tree with buckets.
+func (b *builder[T]) buildLeaf() *node[T] {
+	vantage := b.points[0]
+	n := singleton(vantage, &node[T]{})
+
+	rest := b.points[1:]
+	if len(rest) == 0 {
+		return n
 	}
+	b.dists(vantage.p, rest)
+	n.bucket = make([]bucketPoint[T], len(rest))
+	for i, p := range rest {
+		n.bucket[i].pointDist = p
+	}
+	n.size += len(rest)
+	return n
 }
 
 // Base case with two points.
-func (b *builder) build2() *node {
-	vantage, other := b.points[0].p, b.points[1].p
-
-	var nodes [2]node
-	nodes[0] = node{
-		center: vantage,
-		radius: b.metric(vantage, other),
+func (b *builder[T]) build2() *node[T] {
+	vantage, other := b.points[0], b.points[1]
+
+	var nodes [2]node[T]
+	nodes[0] = node[T]{
+		center: vantage.p,
+		ids:    vantage.ids,
+		count:  vantage.count,
+		radius: b.metric(vantage.p, other.p),
 		inside: singleton(other, &nodes[1]),
+		size:   2,
 	}
 	return &nodes[0]
 }
 
 // Base case with three points.
-func (b *builder) build3() *node {
+func (b *builder[T]) build3() *node[T] {
 	vantage := b.selectVantage()
+	// selectVantage leaves distances to the last candidate it tried,
+	// which need not be the vantage point.
+	for i := range b.points {
+		b.points[i].d = b.metric(vantage.p, b.points[i].p)
+	}
 
 	if b.points[0].d > b.points[1].d {
 		b.swap(0, 1)
 	}
 
-	var nodes [3]node
-	nodes[0] = node{
-		center:  vantage,
+	var nodes [3]node[T]
+	nodes[0] = node[T]{
+		center:  vantage.p,
+		ids:     vantage.ids,
+		count:   vantage.count,
 		radius:  (b.points[0].d + b.points[1].d) / 2,
-		inside:  singleton(b.points[0].p, &nodes[1]),
-		outside: singleton(b.points[1].p, &nodes[2]),
+		inside:  singleton(b.points[0], &nodes[1]),
+		outside: singleton(b.points[1], &nodes[2]),
+		size:    3,
 	}
 	return &nodes[0]
 }
 
 // Construct a singleton tree containing point p in n.
-func singleton(p string, n *node) *node {
-	*n = node{center: p, radius: math.NaN()}
+func singleton[T any](p pointDist[T], n *node[T]) *node[T] {
+	*n = node[T]{
+		center: p.p,
+		ids:    p.ids,
+		count:  p.count,
+		radius: math.NaN(),
+		size:   1,
+	}
 	return n
 }
 
 // Splits a builder in two, dividing the points at index i.
-func (b *builder) split(i int) *builder {
-	var b2 builder
+func (b *builder[T]) split(i int) *builder[T] {
+	var b2 builder[T]
 	b2 = *b
 	b2.rng.Jump()
 
@@ -157,7 +442,7 @@ func (b *builder) split(i int) *builder {
 
 // Quickselect. Points has been shuffled before entry,
 // so no need to bother with fancy pivoting.
-func (b *builder) selectMedian() int {
+func (b *builder[T]) selectMedian() int {
 	median := len(b.points) / 2
 loop:
 	for lo, hi := 0, len(b.points)-1; hi > lo; {
@@ -176,7 +461,7 @@ loop:
 
 // Lomuto partition. Partitions b.dist[lo:hi+1] and b.points[lo:hi+1] around
 // a pivot value and returns the index of the pivot.
-func (b *builder) partition(lo, hi int) int {
+func (b *builder[T]) partition(lo, hi int) int {
 	pivot := b.points[hi].d
 
 	i := lo
@@ -191,13 +476,13 @@ func (b *builder) partition(lo, hi int) int {
 	return i
 }
 
-func (b *builder) swap(i, j int) {
+func (b *builder[T]) swap(i, j int) {
 	b.points[i], b.points[j] = b.points[j], b.points[i]
 }
 
 // Selects, removes and returns a vantage point from b.points.
 // b.points must be shuffled before entry.
-func (b *builder) selectVantage() string {
+func (b *builder[T]) selectVantage() pointDist[T] {
 	// For small numbers of points, compute the exact best vantage point.
 	sample := b.points
 	if len(b.points) >= 6 {
@@ -228,17 +513,17 @@ func (b *builder) selectVantage() string {
 	}
 
 	b.swap(best, 0)
-	vantage := b.points[0].p
+	vantage := b.points[0]
 	b.points = b.points[1:]
 	return vantage
 }
 
 // Mean of a[...].d.
-func average(a []pointDist) float64 {
+func average[T any](a []pointDist[T]) float64 {
 	return sum(a) / float64(len(a))
 }
 
-func sum(a []pointDist) float64 {
+func sum[T any](a []pointDist[T]) float64 {
 	// Recursive sum for stability: O(log n) roundoff error vs. linear for a
 	// straight loop.
 	switch n := len(a); n {
@@ -254,12 +539,12 @@ func sum(a []pointDist) float64 {
 }
 
 // Mean absolute deviation of a[...].d given its mean.
-func meanabsdev(a []pointDist, mean float64) float64 {
+func meanabsdev[T any](a []pointDist[T], mean float64) float64 {
 	return sumabsdev(a, mean) / float64(len(a))
 }
 
 // Sum of absolute deviations of a[...] from m.
-func sumabsdev(a []pointDist, m float64) float64 {
+func sumabsdev[T any](a []pointDist[T], m float64) float64 {
 	// See comment in sum function above.
 	switch n := len(a); n {
 	case 0:
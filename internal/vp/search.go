@@ -3,14 +3,18 @@ package vp
 import (
 	"container/heap"
 	"context"
+	"math"
 	"sort"
+	"time"
 )
 
-type Predicate func(string) bool
+type Predicate[T any] func(T) bool
 
-type Result struct {
-	Dist  float64 `json:"distance"`
-	Point string  `json:"point"`
+type Result[T any] struct {
+	Dist  float64  `json:"distance"`
+	Point T        `json:"point"`
+	Count int      `json:"count"`         // Number of occurrences of Point.
+	IDs   []string `json:"ids,omitempty"` // Identifiers associated with Point.
 }
 
 // Search performs a generalized nearest neighbors search.
@@ -18,90 +22,370 @@ type Result struct {
 // all points farther than maxDist and all points for which pred returns false.
 //
 // The returned points are sorted by distance from p, so the nearest neighbor
-// is at index 0.
+// is at index 0. Which of the points at the k-th distance are returned
+// is unspecified; use SearchWith to control this.
 //
 // To do a regular nearest neighbors search, set maxDist to math.Inf(+1).
 //
-// Search returns an error if and only if the context ctx expires.
+// Search returns an error if and only if the context ctx expires. It then
+// stops early and returns the best results found so far along with
+// ctx.Err(); these are sorted, but may not be the nearest neighbors.
 // If ctx is nil, context.Background() is used instead.
 // If pred is nil, a function that always returns true is used instead.
-func (t *Tree) Search(ctx context.Context, p string, k int, maxDist float64, pred Predicate) ([]Result, error) {
+func (t *Tree[T]) Search(ctx context.Context, p T, k int, maxDist float64, pred Predicate[T]) ([]Result[T], error) {
+	return t.SearchWith(ctx, p, k, maxDist, pred, Options{})
+}
+
+// Options are optional parameters for SearchWith.
+type Options struct {
+	// If Stats is not nil, statistics about the search are stored in it.
+	Stats *Stats
+
+	// Ties determines which of the points at equal distances from the query
+	// are returned first, and which are kept when not all of them fit in k.
+	Ties TieBreak
+
+	// If IncludeTies is set, all points at the same distance as the k-th
+	// result are returned, so there may be more than k results.
+	IncludeTies bool
+
+	// IDLess orders identifiers for ByID. If it is nil, identifiers are
+	// compared as strings.
+	IDLess func(a, b string) bool
+}
+
+// A TieBreak is a ranking of points at equal distances from a query.
+//
+// All rankings except AnyOrder are deterministic for strings: points that
+// are still tied are ranked lexicographically. For other types of points,
+// the order among those is unspecified.
+type TieBreak int
+
+const (
+	// Points at equal distances are ranked in an unspecified order,
+	// which may depend on the structure of the index.
+	AnyOrder TieBreak = iota
+	// Points that occur more often are ranked first.
+	ByFrequency
+	// Points are ranked lexicographically.
+	Lexicographic
+	// Points are ranked by their first identifier, compared by
+	// Options.IDLess or as strings. Points without identifiers come last.
+	ByID
+)
+
+// Stats are statistics about a search.
+type Stats struct {
+	DistCalls int           `json:"distance_calls"` // Number of metric evaluations.
+	Visited   int           `json:"nodes_visited"`
+	Pruned    int           `json:"subtrees_pruned"` // Subtrees not visited.
+	Skipped   int           `json:"points_skipped"`  // Bucket points not compared.
+	MaxDepth  int           `json:"max_depth"`       // Depth of the root is zero.
+	Elapsed   time.Duration `json:"elapsed_ns"`
+}
+
+// Adds the counts in other to st, except for Elapsed. MaxDepth becomes
+// the maximum of the two.
+func (st *Stats) add(other *Stats) {
+	st.DistCalls += other.DistCalls
+	st.Visited += other.Visited
+	st.Pruned += other.Pruned
+	st.Skipped += other.Skipped
+	if other.MaxDepth > st.MaxDepth {
+		st.MaxDepth = other.MaxDepth
+	}
+}
+
+// SearchWith is like Search, but takes additional options.
+func (t *Tree[T]) SearchWith(ctx context.Context, p T, k int, maxDist float64, pred Predicate[T], opts Options) ([]Result[T], error) {
+	start := time.Now()
+	s := newSearcher(ctx, t.metric, p, k, maxDist, pred)
+	s.setOptions(opts)
+
+	t.mu.RLock()
+	s.search(t.root, 0)
+	t.mu.RUnlock()
+
+	s.stats.Elapsed = time.Since(start)
+	if opts.Stats != nil {
+		*opts.Stats = s.stats
+	}
+	return s.finish()
+}
+
+// Range returns all points in t within distance radius of p
+// for which pred returns true, sorted by distance from p.
+// Strings at equal distances are sorted lexicographically.
+//
+// Range returns an error if and only if the context ctx expires, along with
+// the points found so far, as Search does.
+// If ctx is nil, context.Background() is used instead.
+// If pred is nil, a function that always returns true is used instead.
+func (t *Tree[T]) Range(ctx context.Context, p T, radius float64, pred Predicate[T]) ([]Result[T], error) {
+	s := newSearcher(ctx, t.metric, p, 0, radius, pred)
+	s.unbounded = true
+
+	t.mu.RLock()
+	s.search(t.root, 0)
+	t.mu.RUnlock()
+
+	return s.finish()
+}
+
+type searcher[T any] struct {
+	ctx    context.Context
+	err    error
+	metric Metric[T]
+	pred   Predicate[T]
+	query  T
+	radius float64
+	result byDistance[T] // cap(result) is the number of neighbors wanted.
+
+	// Find all points within radius, not just cap(result).
+	unbounded bool
+
+	// Radius shared with the searchers of other shards, or nil.
+	shared *sharedRadius
+
+	stats Stats
+}
+
+func newSearcher[T any](ctx context.Context, m Metric[T], p T, k int, maxDist float64, pred Predicate[T]) *searcher[T] {
 	if pred == nil {
-		pred = all
+		pred = all[T]
 	}
 	if ctx == nil {
 		ctx = context.Background()
 	}
-	s := searcher{
+	return &searcher[T]{
 		ctx:    ctx,
+		metric: m,
 		query:  p,
 		pred:   pred,
 		radius: maxDist,
-		result: make([]Result, 0, k),
-		t:      t,
-	}
-	s.search(t.root)
-	if s.err != nil {
-		return nil, s.err
+		result: byDistance[T]{
+			results: make([]Result[T], 0, k),
+			less:    lessFunc[T](),
+		},
 	}
-	sort.Sort(sort.Reverse(byDistance(s.result)))
-	return s.result, nil
 }
 
-type searcher struct {
-	ctx    context.Context
-	err    error
-	pred   Predicate
-	query  string
-	radius float64
-	result byDistance // cap(result) is the number of neighbors wanted.
-	t      *Tree
+func (s *searcher[T]) setOptions(opts Options) {
+	s.result.ties = opts.Ties
+	s.result.includeTies = opts.IncludeTies
+	s.result.idLess = opts.IDLess
 }
 
-func (s *searcher) search(n *node) {
-	if n == nil {
-		return
-	}
+// Returns the result of a search, sorted, and the error from the context
+// if the search was canceled. Points that the tie-breaking order leaves
+// tied are sorted lexicographically, if they are strings.
+func (s *searcher[T]) finish() ([]Result[T], error) {
+	res := &s.result
+	results := append(res.results, res.tied...)
+	sort.Slice(results, func(i, j int) bool {
+		a, b := &results[i], &results[j]
+		switch {
+		case res.before(a, b):
+			return true
+		case res.before(b, a):
+			return false
+		}
+		return res.less != nil && res.less(a.Point, b.Point)
+	})
+	return results, s.err
+}
+
+// Reports whether the search has been canceled.
+func (s *searcher[T]) canceled() bool {
 	select {
 	case <-s.ctx.Done():
 		s.err = s.ctx.Err()
-		return
+		return true
 	default:
+		return false
+	}
+}
+
+// Reports whether r belongs in the result. Only r.Point, r.Dist and r.Count
+// need to be set, and r.IDs if the results are ranked by ID.
+func (s *searcher[T]) admits(r *Result[T]) bool {
+	res := &s.result
+	switch {
+	case r.Dist > s.radius:
+		return false
+	case s.unbounded:
+	case cap(res.results) == 0:
+		return false
+	case len(res.results) == cap(res.results) && !res.before(r, &res.results[0]):
+		if !res.includeTies || r.Dist != res.results[0].Dist {
+			return false
+		}
+	}
+	return s.pred(r.Point)
+}
+
+// Adds r to the result. The caller must check admits first.
+func (s *searcher[T]) add(r Result[T]) {
+	res := &s.result
+	switch {
+	case s.unbounded:
+		res.results = append(res.results, r)
+	case len(res.results) < cap(res.results):
+		res.results = append(res.results, r)
+		heap.Fix(res, len(res.results)-1)
+		if len(res.results) == cap(res.results) {
+			// Only points as near as the k-th can make it in from now on.
+			s.radius = res.results[0].Dist
+		}
+	case !res.before(&r, &res.results[0]):
+		// Admitted because it is tied with the k-th result.
+		res.tied = append(res.tied, r)
+	default:
+		worst := res.results[0]
+		res.results[0] = r
+		heap.Fix(res, 0)
+		s.radius = res.results[0].Dist
+		switch {
+		case worst.Dist > s.radius:
+			res.tied = res.tied[:0]
+		case res.includeTies:
+			res.tied = append(res.tied, worst)
+		}
+	}
+	if s.shared != nil && len(res.results) == cap(res.results) {
+		s.shared.lower(res.results[0].Dist)
+	}
+}
+
+func (s *searcher[T]) search(n *node[T], depth int) {
+	if n == nil || s.canceled() {
+		return
+	}
+	s.visit(depth)
+	if n.ndel == n.size {
+		return
+	}
+	if s.shared != nil {
+		s.radius = math.Min(s.radius, s.shared.load())
 	}
 
-	d := s.t.metric(s.query, n.center)
-	if d <= s.radius && s.pred(n.center) {
-		if len(s.result) < cap(s.result) {
-			s.result = append(s.result, Result{Point: n.center, Dist: d})
-			heap.Fix(&s.result, len(s.result)-1)
-		} else if d < s.result[0].Dist {
-			s.result[0] = Result{Point: n.center, Dist: d}
-			heap.Fix(&s.result, 0)
-			s.radius = s.result[0].Dist
+	d := s.dist(n.center)
+	r := Result[T]{Point: n.center, Dist: d, Count: n.count, IDs: n.ids}
+	if !n.deleted && s.admits(&r) {
+		s.add(r)
+	}
+	for i := range n.bucket {
+		b := &n.bucket[i]
+		if b.deleted {
+			continue
+		}
+		r := Result[T]{Point: b.p, Count: b.count, IDs: b.ids}
+		if s.scan(&r, b.d, d) {
+			s.add(r)
 		}
 	}
 
 	if d < n.radius {
-		s.search(n.inside)
+		s.search(n.inside, depth+1)
 		if d+s.radius >= n.radius {
-			s.search(n.outside)
+			s.search(n.outside, depth+1)
+		} else if n.outside != nil {
+			s.stats.Pruned++
 		}
 	} else {
-		s.search(n.outside)
+		s.search(n.outside, depth+1)
 		if d-s.radius <= n.radius {
-			s.search(n.inside)
+			s.search(n.inside, depth+1)
+		} else if n.inside != nil {
+			s.stats.Pruned++
 		}
 	}
 }
 
+// Reports whether the point r.Point from the bucket of a leaf belongs in
+// the result, and sets r.Dist if it might. pd is the distance from the
+// point to the center of the leaf, d that from the query to the center.
+// The other fields of r must be set as for admits.
+func (s *searcher[T]) scan(r *Result[T], pd, d float64) bool {
+	// By the triangle inequality, the distance from the query to the point
+	// is at least |d - pd|.
+	if math.Abs(d-pd) > s.radius {
+		s.stats.Skipped++
+		return false
+	}
+	r.Dist = s.dist(r.Point)
+	return s.admits(r)
+}
+
+// Records a visit to a node at the given depth.
+func (s *searcher[T]) visit(depth int) {
+	s.stats.Visited++
+	if depth > s.stats.MaxDepth {
+		s.stats.MaxDepth = depth
+	}
+}
+
+// Returns the distance from the query to p.
+func (s *searcher[T]) dist(p T) float64 {
+	s.stats.DistCalls++
+	return s.metric(s.query, p)
+}
+
 // Default predicate for searchers.
-func all(string) bool { return true }
+func all[T any](T) bool { return true }
 
-// byDistance sorts Results in descending order of Dist.
-type byDistance []Result
+// byDistance sorts Results from worst to best, so that the root of a heap
+// of them is the worst result.
+type byDistance[T any] struct {
+	results []Result[T]
+	ties    TieBreak
+	less    func(a, b T) bool      // Lexicographic order, or nil.
+	idLess  func(a, b string) bool // Order of identifiers, or nil.
 
-func (r byDistance) Len() int            { return len(r) }
-func (r byDistance) Less(i, j int) bool  { return r[i].Dist > r[j].Dist }
-func (r *byDistance) Pop() interface{}   { panic("use heap.Fix, not heap.Pop") }
-func (r *byDistance) Push(x interface{}) { panic("use heap.Fix, not heap.Push") }
-func (r byDistance) Swap(i, j int)       { r[i], r[j] = r[j], r[i] }
+	// Results at the distance of results[0] that rank after it,
+	// if includeTies is set.
+	tied        []Result[T]
+	includeTies bool
+}
+
+// Reports whether a ranks before b.
+func (r *byDistance[T]) before(a, b *Result[T]) bool {
+	if a.Dist != b.Dist {
+		return a.Dist < b.Dist
+	}
+	switch r.ties {
+	case AnyOrder:
+		return false
+	case ByFrequency:
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+	case ByID:
+		switch {
+		case len(a.IDs) == 0 || len(b.IDs) == 0:
+			if len(a.IDs) != len(b.IDs) {
+				return len(b.IDs) == 0
+			}
+		case r.idLess != nil:
+			if r.idLess(a.IDs[0], b.IDs[0]) {
+				return true
+			}
+			if r.idLess(b.IDs[0], a.IDs[0]) {
+				return false
+			}
+		case a.IDs[0] != b.IDs[0]:
+			return a.IDs[0] < b.IDs[0]
+		}
+	}
+	return r.less != nil && r.less(a.Point, b.Point)
+}
+
+func (r *byDistance[T]) Len() int { return len(r.results) }
+func (r *byDistance[T]) Less(i, j int) bool {
+	return r.before(&r.results[j], &r.results[i])
+}
+func (r *byDistance[T]) Pop() interface{}   { panic("use heap.Fix, not heap.Pop") }
+func (r *byDistance[T]) Push(x interface{}) { panic("use heap.Fix, not heap.Push") }
+func (r *byDistance[T]) Swap(i, j int) {
+	r.results[i], r.results[j] = r.results[j], r.results[i]
+}
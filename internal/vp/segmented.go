@@ -0,0 +1,430 @@
+package vp
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/knaw-huc/levenserv/internal/tinyrng"
+)
+
+// A Segmented index supports cheap insertions and deletions, in the manner
+// of a log-structured merge tree.
+//
+// New points go into a small mutable segment that is searched by brute
+// force. When that fills up, it is frozen, and a background goroutine
+// builds a Tree from it. The background goroutine also merges Trees of
+// similar sizes, so that the number of segments stays logarithmic in the
+// number of points. Frozen segments are never modified: deleting a point
+// from one leaves a tombstone, which hides the point until the segment is
+// merged.
+//
+// Each distinct point occurs in only one segment. Inserting a point that
+// is already in a frozen segment moves it to the mutable segment.
+//
+// The methods of a Segmented may be called from multiple goroutines
+// concurrently.
+type Segmented[T comparable] struct {
+	metric Metric[T]
+	opts   BuildOptions // For building Trees.
+	limit  int          // Maximum size of the mutable segment.
+
+	mu       sync.RWMutex   // Protects the fields below.
+	mem      []pointDist[T] // The mutable segment.
+	memIndex map[T]int      // Positions of the points in mem.
+	segs     []*segment[T]  // Frozen segments, oldest first.
+	gen      int            // Number of segments frozen so far.
+	nelem    int
+
+	// A point p is hidden in the frozen segments with hi <= tomb[p].
+	tomb map[T]int
+
+	rng  tinyrng.SplitMix64 // Seeds for building Trees.
+	busy bool               // Whether the background goroutine is running.
+	wg   sync.WaitGroup
+}
+
+// A segment is a frozen segment of a Segmented. Its points are in tree,
+// or in points until the tree has been built.
+type segment[T any] struct {
+	tree   *Tree[T]
+	points []pointDist[T]
+	size   int // Number of points at the time of freezing or merging.
+	hi     int // Number of segments frozen when its newest points were.
+}
+
+// Default maximum size of the mutable segment of a Segmented.
+const defaultSegmentSize = 1024
+
+// A frozen segment is merged with the next one when it is no more than
+// this many times as large.
+const segmentMergeRatio = 2
+
+// NewSegmented constructs a Segmented from the points, using the metric m.
+// The mutable segment holds up to segmentSize points; if segmentSize is
+// zero, a default is used. The initial points are stored in a single Tree,
+// built using opts as by Build. opts.Seed also seeds the construction of
+// later Trees, and opts.Workers and opts.LeafSize apply to them.
+//
+// NewSegmented panics if opts.IDs is not nil and has a different length
+// than points.
+func NewSegmented[T comparable](ctx context.Context, m Metric[T], points []T, segmentSize int, opts BuildOptions) (*Segmented[T], error) {
+	if segmentSize <= 0 {
+		segmentSize = defaultSegmentSize
+	}
+	s := &Segmented[T]{
+		metric:   m,
+		opts:     opts,
+		limit:    segmentSize,
+		memIndex: make(map[T]int),
+		tomb:     make(map[T]int),
+	}
+	s.rng.Seed(opts.Seed)
+
+	if len(points) > 0 {
+		opts.Seed = s.rng.Int63()
+		t, err := Build(ctx, m, points, opts)
+		if err != nil {
+			return nil, err
+		}
+		s.gen++
+		s.segs = []*segment[T]{{tree: t, size: t.nelem, hi: s.gen}}
+		s.nelem = t.nelem
+	}
+	s.opts.IDs = nil
+	return s, nil
+}
+
+// Insert adds the point p to s, with the identifiers ids. If p already
+// occurs in s, its count is incremented and the identifiers are added to
+// those of the existing point instead.
+//
+// Insert may be stopped by canceling ctx, in which case ctx.Err() is
+// returned and s is left unchanged. If ctx is nil, context.Background()
+// is used.
+func (s *Segmented[T]) Insert(ctx context.Context, p T, ids ...string) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if i, ok := s.memIndex[p]; ok {
+		q := &s.mem[i]
+		q.count++
+		if len(ids) > 0 {
+			// Reallocate, since searches may have returned the old slice.
+			q.ids = append(q.ids[:len(q.ids):len(q.ids)], ids...)
+		}
+		return nil
+	}
+
+	q := pointDist[T]{p: p, ids: ids, count: 1}
+	old, err := s.lookup(ctx, p)
+	switch {
+	case err != nil:
+		return err
+	case old != nil:
+		q.count += old.count
+		q.ids = append(old.ids[:len(old.ids):len(old.ids)], ids...)
+		s.tomb[p] = s.gen
+	default:
+		s.nelem++
+	}
+
+	s.memIndex[p] = len(s.mem)
+	s.mem = append(s.mem, q)
+	if len(s.mem) >= s.limit {
+		s.freeze()
+	}
+	return nil
+}
+
+// Delete removes all occurrences of the point p from s and reports whether
+// p occurred in s.
+func (s *Segmented[T]) Delete(p T) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if i, ok := s.memIndex[p]; ok {
+		last := len(s.mem) - 1
+		s.mem[i] = s.mem[last]
+		s.memIndex[s.mem[i].p] = i
+		s.mem = s.mem[:last]
+		delete(s.memIndex, p)
+		s.nelem--
+		return true
+	}
+
+	if old, _ := s.lookup(context.Background(), p); old != nil {
+		s.tomb[p] = s.gen
+		s.nelem--
+		return true
+	}
+	return false
+}
+
+// Returns the point p in the frozen segments, if it occurs there and is
+// not hidden, or nil.
+//
+// The caller must hold s.mu for writing.
+func (s *Segmented[T]) lookup(ctx context.Context, p T) (*pointDist[T], error) {
+	for i := len(s.segs) - 1; i >= 0; i-- {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		seg := s.segs[i]
+		if s.hidden(p, seg.hi) {
+			// Then it is also hidden in the older segments.
+			break
+		}
+		if seg.tree == nil {
+			for j := range seg.points {
+				if seg.points[j].p == p {
+					return &seg.points[j], nil
+				}
+			}
+			continue
+		}
+		if ids, count := seg.tree.find(seg.tree.root, p); count != nil {
+			return &pointDist[T]{p: p, ids: *ids, count: *count}, nil
+		}
+	}
+	return nil, nil
+}
+
+// Reports whether p is hidden in frozen segments with the given hi.
+func (s *Segmented[T]) hidden(p T, hi int) bool {
+	g, ok := s.tomb[p]
+	return ok && hi <= g
+}
+
+// Freezes the mutable segment and starts the background goroutine
+// to build a Tree from it.
+//
+// The caller must hold s.mu for writing.
+func (s *Segmented[T]) freeze() {
+	s.gen++
+	s.segs = append(s.segs, &segment[T]{
+		points: s.mem,
+		size:   len(s.mem),
+		hi:     s.gen,
+	})
+	s.mem = nil
+	s.memIndex = make(map[T]int)
+
+	if !s.busy {
+		s.busy = true
+		s.wg.Add(1)
+		go s.compact()
+	}
+}
+
+// Builds Trees for frozen segments and merges them, until there is
+// nothing left to do.
+func (s *Segmented[T]) compact() {
+	defer s.wg.Done()
+
+	for {
+		s.mu.Lock()
+		job := s.nextJob()
+		if job == nil {
+			s.busy = false
+			s.mu.Unlock()
+			return
+		}
+		merged := &segment[T]{}
+		var points []pointDist[T]
+		for _, seg := range job {
+			points = s.collect(points, seg)
+			if seg.hi > merged.hi {
+				merged.hi = seg.hi
+			}
+		}
+		opts := s.opts
+		opts.Seed = s.rng.Int63()
+		s.mu.Unlock()
+
+		// Points deleted in the meantime get tombstones that also
+		// apply to the merged segment, since it has the same hi as
+		// the newest of its inputs.
+		merged.tree, _ = newTree(nil, s.metric, points, opts, newWorkerPool(opts.Workers))
+		merged.size = len(points)
+
+		s.mu.Lock()
+		s.replace(job, merged)
+		s.mu.Unlock()
+	}
+}
+
+// Returns the frozen segments to be merged next, or nil. A segment without
+// a Tree is "merged" by itself.
+//
+// The caller must hold s.mu.
+func (s *Segmented[T]) nextJob() []*segment[T] {
+	for i, seg := range s.segs {
+		if seg.tree == nil {
+			return []*segment[T]{s.segs[i]}
+		}
+	}
+	for i := len(s.segs) - 1; i > 0; i-- {
+		if s.segs[i-1].size <= segmentMergeRatio*s.segs[i].size {
+			return []*segment[T]{s.segs[i-1], s.segs[i]}
+		}
+	}
+	return nil
+}
+
+// Appends the points of seg that are not hidden to points.
+//
+// The caller must hold s.mu.
+func (s *Segmented[T]) collect(points []pointDist[T], seg *segment[T]) []pointDist[T] {
+	keep := func(p *pointDist[T]) bool {
+		if !s.hidden(p.p, seg.hi) {
+			points = append(points, *p)
+		}
+		return true
+	}
+	if seg.tree == nil {
+		for i := range seg.points {
+			keep(&seg.points[i])
+		}
+	} else {
+		seg.tree.root.doPoints(keep)
+	}
+	return points
+}
+
+// Replaces the consecutive frozen segments in job by merged, then drops
+// the tombstones that no longer apply to any segment.
+//
+// The caller must hold s.mu for writing.
+func (s *Segmented[T]) replace(job []*segment[T], merged *segment[T]) {
+	i := 0
+	for s.segs[i] != job[0] {
+		i++
+	}
+	segs := append([]*segment[T]{}, s.segs[:i]...)
+	if merged.size > 0 {
+		segs = append(segs, merged)
+	}
+	s.segs = append(segs, s.segs[i+len(job):]...)
+
+	minHi := s.gen + 1
+	for _, seg := range s.segs {
+		if seg.hi < minHi {
+			minHi = seg.hi
+		}
+	}
+	for p, g := range s.tomb {
+		if g < minHi {
+			delete(s.tomb, p)
+		}
+	}
+}
+
+// Wait waits for the background goroutine to finish building and merging
+// Trees. It must not be called concurrently with Insert.
+func (s *Segmented[T]) Wait() { s.wg.Wait() }
+
+// Segments reports the number of segments in s, including the mutable one.
+func (s *Segmented[T]) Segments() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.segs) + 1
+}
+
+// Do calls f on each item in s, in some unspecified order,
+// until f returns false.
+func (s *Segmented[T]) Do(f func(T) bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ok := true
+	for _, seg := range s.segs {
+		if seg.tree == nil {
+			for i := range seg.points {
+				if p := seg.points[i].p; !s.hidden(p, seg.hi) && !f(p) {
+					return
+				}
+			}
+			continue
+		}
+		seg.tree.root.doPoints(func(p *pointDist[T]) bool {
+			ok = s.hidden(p.p, seg.hi) || f(p.p)
+			return ok
+		})
+		if !ok {
+			return
+		}
+	}
+	for i := range s.mem {
+		if !f(s.mem[i].p) {
+			return
+		}
+	}
+}
+
+// Len reports the number of distinct elements in s.
+func (s *Segmented[T]) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.nelem
+}
+
+// Search is like Tree.Search.
+func (s *Segmented[T]) Search(ctx context.Context, p T, k int, maxDist float64, pred Predicate[T]) ([]Result[T], error) {
+	return s.SearchWith(ctx, p, k, maxDist, pred, Options{})
+}
+
+// SearchWith is like Tree.SearchWith.
+func (s *Segmented[T]) SearchWith(ctx context.Context, p T, k int, maxDist float64, pred Predicate[T], opts Options) ([]Result[T], error) {
+	start := time.Now()
+	sr := newSearcher(ctx, s.metric, p, k, maxDist, pred)
+	sr.setOptions(opts)
+	s.search(sr)
+
+	sr.stats.Elapsed = time.Since(start)
+	if opts.Stats != nil {
+		*opts.Stats = sr.stats
+	}
+	return sr.finish()
+}
+
+// Range is like Tree.Range.
+func (s *Segmented[T]) Range(ctx context.Context, p T, radius float64, pred Predicate[T]) ([]Result[T], error) {
+	sr := newSearcher(ctx, s.metric, p, 0, radius, pred)
+	sr.unbounded = true
+	s.search(sr)
+	return sr.finish()
+}
+
+// Searches the segments one after another with the same searcher,
+// so that the radius found in one segment prunes the next.
+func (s *Segmented[T]) search(sr *searcher[T]) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	pred := sr.pred
+	for _, seg := range s.segs {
+		if len(s.tomb) > 0 {
+			hi := seg.hi
+			sr.pred = func(p T) bool { return !s.hidden(p, hi) && pred(p) }
+		}
+		if seg.tree == nil {
+			sr.scanLinear(seg.points)
+		} else {
+			// Frozen Trees are not modified, so there is no need
+			// to lock them.
+			sr.search(seg.tree.root, 0)
+		}
+		if sr.err != nil {
+			return
+		}
+	}
+	sr.pred = pred
+	sr.scanLinear(s.mem)
+}
@@ -0,0 +1,203 @@
+package vp
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/knaw-huc/levenserv/internal/tinyrng"
+)
+
+// A Sharded index splits its points over several Trees, which are built
+// in parallel and searched concurrently. This lets a single search use
+// multiple CPUs.
+//
+// While searching, the shards share the distance of the k-th best result
+// found so far by any of them, so that each shard can prune subtrees that
+// another shard has already ruled out.
+//
+// The methods of a Sharded may be called from multiple goroutines
+// concurrently.
+type Sharded[T any] struct {
+	metric Metric[T]
+	shards []*Tree[T]
+}
+
+// NewSharded constructs a Sharded index of n Trees from the points, using
+// the metric m. The options are as for Build; opts.Workers limits the
+// number of goroutines for all shards together. Equal points are stored in
+// the same shard.
+//
+// NewSharded panics if n < 1, or if opts.IDs is not nil and has a different
+// length than points.
+func NewSharded[T any](ctx context.Context, m Metric[T], points []T, n int, opts BuildOptions) (*Sharded[T], error) {
+	if n < 1 {
+		panic("vp: number of shards must be positive")
+	}
+	if opts.IDs != nil && len(points) != len(opts.IDs) {
+		panic("vp: number of points and identifiers differ")
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	var (
+		all   = collapse(points, opts.IDs)
+		pool  = newWorkerPool(opts.Workers)
+		rng   tinyrng.SplitMix64
+		errs  = make([]error, n)
+		waits = make([]func(), n)
+	)
+	rng.Seed(opts.Seed)
+	sh := &Sharded[T]{metric: m, shards: make([]*Tree[T], n)}
+	for i := range sh.shards {
+		part := all[:len(all)/(n-i)]
+		all = all[len(part):]
+
+		i, shardOpts := i, opts
+		shardOpts.Seed = rng.Int63()
+		waits[i] = pool.start(func() {
+			sh.shards[i], errs[i] = newTree(ctx, m, part, shardOpts, pool)
+		})
+	}
+	for _, wait := range waits {
+		wait()
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sh, nil
+}
+
+// Do calls f on each item in sh, in some unspecified order,
+// until f returns false.
+func (sh *Sharded[T]) Do(f func(T) bool) {
+	ok := true
+	for _, t := range sh.shards {
+		t.Do(func(p T) bool {
+			ok = f(p)
+			return ok
+		})
+		if !ok {
+			return
+		}
+	}
+}
+
+// Len reports the number of distinct elements in sh.
+func (sh *Sharded[T]) Len() (n int) {
+	for _, t := range sh.shards {
+		n += t.Len()
+	}
+	return n
+}
+
+// Shards reports the number of shards in sh.
+func (sh *Sharded[T]) Shards() int { return len(sh.shards) }
+
+// Search is like Tree.Search.
+func (sh *Sharded[T]) Search(ctx context.Context, p T, k int, maxDist float64, pred Predicate[T]) ([]Result[T], error) {
+	return sh.SearchWith(ctx, p, k, maxDist, pred, Options{})
+}
+
+// SearchWith is like Tree.SearchWith. The statistics are summed over the
+// shards, except for MaxDepth, which is the maximum.
+func (sh *Sharded[T]) SearchWith(ctx context.Context, p T, k int, maxDist float64, pred Predicate[T], opts Options) ([]Result[T], error) {
+	start := time.Now()
+	s := newSearcher(ctx, sh.metric, p, k, maxDist, pred)
+	s.setOptions(opts)
+	sh.search(s)
+
+	s.stats.Elapsed = time.Since(start)
+	if opts.Stats != nil {
+		*opts.Stats = s.stats
+	}
+	return s.finish()
+}
+
+// Range is like Tree.Range.
+func (sh *Sharded[T]) Range(ctx context.Context, p T, radius float64, pred Predicate[T]) ([]Result[T], error) {
+	s := newSearcher(ctx, sh.metric, p, 0, radius, pred)
+	s.unbounded = true
+	sh.search(s)
+	return s.finish()
+}
+
+// Searches all shards concurrently, with a copy of s for each,
+// then merges the results into s.
+func (sh *Sharded[T]) search(s *searcher[T]) {
+	var (
+		parts  = make([]searcher[T], len(sh.shards))
+		shared = newSharedRadius(s.radius)
+		wg     sync.WaitGroup
+	)
+	for i, t := range sh.shards {
+		parts[i] = *s
+		parts[i].result.results = make([]Result[T], 0, cap(s.result.results))
+		if !s.unbounded {
+			parts[i].shared = shared
+		}
+		wg.Add(1)
+		go func(s *searcher[T], t *Tree[T]) {
+			defer wg.Done()
+			t.mu.RLock()
+			defer t.mu.RUnlock()
+			s.search(t.root, 0)
+		}(&parts[i], t)
+	}
+	wg.Wait()
+
+	for i := range parts {
+		s.merge(&parts[i])
+	}
+}
+
+// Merges the results and statistics of a search of part of an index into s.
+func (s *searcher[T]) merge(part *searcher[T]) {
+	if part.err != nil {
+		s.err = part.err
+	}
+
+	s.stats.add(&part.stats)
+
+	// The part has already applied the predicate.
+	pred := s.pred
+	s.pred = all[T]
+	for _, results := range [][]Result[T]{part.result.results, part.result.tied} {
+		for _, r := range results {
+			if s.admits(&r) {
+				s.add(r)
+			}
+		}
+	}
+	s.pred = pred
+}
+
+// A sharedRadius is a search radius that can only shrink, shared by
+// goroutines.
+type sharedRadius struct {
+	bits uint64 // math.Float64bits of the radius.
+}
+
+func newSharedRadius(r float64) *sharedRadius {
+	return &sharedRadius{bits: math.Float64bits(r)}
+}
+
+func (r *sharedRadius) load() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&r.bits))
+}
+
+// Sets the radius to x if that is smaller than its current value.
+func (r *sharedRadius) lower(x float64) {
+	for {
+		old := atomic.LoadUint64(&r.bits)
+		if math.Float64frombits(old) <= x ||
+			atomic.CompareAndSwapUint64(&r.bits, old, math.Float64bits(x)) {
+			return
+		}
+	}
+}
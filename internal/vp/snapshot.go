@@ -0,0 +1,474 @@
+package vp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"strings"
+)
+
+// Snapshot format. All integers are little-endian.
+//
+//	magic        [8]byte  "levenvp\x00"
+//	version      uint32
+//	leaf size    uint32   maximum number of points in a bucket
+//	seed         int64
+//	nnodes       uint64
+//	nids         uint64
+//	arenaLen     uint64
+//	metric name  uint32 length, then bytes
+//	norm name    uint32 length, then bytes
+//	padding      to a multiple of 8 bytes
+//	nodes        nnodes records of 48 bytes, in preorder
+//	identifiers  nids records of 16 bytes
+//	arena        arenaLen bytes, the concatenated centers and identifiers
+//	padding      to a multiple of 8 bytes
+//	checksum     uint32   CRC-32C of everything before it
+//
+// A node record is a flatNode:
+//
+//	radius       float64
+//	center       uint64 offset into arena, uint32 length
+//	inside       uint32 node index, zero if absent
+//	outside      uint32 node index, zero if absent
+//	flags        uint32
+//	identifiers  uint32 index of first, uint32 count
+//	count        uint64 number of occurrences of center
+//
+// The root is at index zero, so no node has it as a child.
+//
+// A leaf with a bucket has the flagBucket flag. Its inside field is then
+// the index of the first point in its bucket, which is the next record,
+// and its outside field the number of points. Those points have records
+// of their own, with the flagInBucket flag and, instead of a radius,
+// the distance to the center of the leaf.
+//
+// An identifier record is an idRef:
+//
+//	identifier   uint64 offset into arena, uint32 length
+//	padding      uint32 zero
+const (
+	snapshotMagic   = "levenvp\x00"
+	snapshotVersion = 4
+
+	flatNodeSize = 48
+	idRefSize    = 16
+	maxNameLen   = 1 << 10 // Sanity check for metric and normalization names.
+)
+
+// Node flags.
+const (
+	flagDeleted = 1 << iota
+	flagBucket
+	flagInBucket
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errCorrupt = errors.New("vp: corrupt snapshot")
+)
+
+// SetNames records the names of the metric and of the Unicode normalization
+// that were used to construct t. WriteTo stores these names in snapshots
+// and ReadFrom checks them.
+func (t *Tree[T]) SetNames(metric, norm string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.metricName, t.normName = metric, norm
+}
+
+// WriteTo writes a snapshot of t to w, which can be read back with ReadFrom
+// or LoadFlat. It implements io.WriterTo.
+func (t *StringTree) WriteTo(w io.Writer) (n int64, err error) {
+	return t.Flatten().WriteTo(w)
+}
+
+// WriteTo writes a snapshot of f to w, which can be read back with
+// StringTree.ReadFrom or LoadFlat. It implements io.WriterTo.
+func (f *Flat) WriteTo(w io.Writer) (n int64, err error) {
+	if uint64(len(f.nodes)) > math.MaxUint32 {
+		return 0, errors.New("vp: tree too large for snapshot")
+	}
+
+	sw := &snapshotWriter{w: bufio.NewWriter(w)}
+
+	sw.write([]byte(snapshotMagic))
+	sw.uint32(snapshotVersion)
+	sw.uint32(uint32(f.leafSize))
+	sw.uint64(uint64(f.seed))
+	sw.uint64(uint64(len(f.nodes)))
+	sw.uint64(uint64(len(f.idRefs)))
+	sw.uint64(uint64(len(f.arena)))
+	sw.string(f.metricName)
+	sw.string(f.normName)
+	sw.pad()
+
+	for i := range f.nodes {
+		n := &f.nodes[i]
+		sw.uint64(math.Float64bits(n.radius))
+		sw.uint64(n.offset)
+		sw.uint32(n.length)
+		sw.uint32(n.inside)
+		sw.uint32(n.outside)
+		sw.uint32(n.flags)
+		sw.uint32(n.firstID)
+		sw.uint32(n.nids)
+		sw.uint64(n.count)
+	}
+	for _, ref := range f.idRefs {
+		sw.uint64(ref.offset)
+		sw.uint32(ref.length)
+		sw.uint32(0)
+	}
+	sw.write([]byte(f.arena))
+	sw.pad()
+
+	sw.uint32(sw.crc)
+	if sw.err == nil {
+		sw.err = sw.w.Flush()
+	}
+	return sw.n, sw.err
+}
+
+// ReadFrom replaces the contents of t by a snapshot read from r.
+// It implements io.ReaderFrom.
+//
+// The metric of t is retained. ReadFrom returns an error if the names of
+// the metric and normalization stored in the snapshot differ from those
+// set on t by SetNames, or if the snapshot is corrupt.
+func (t *StringTree) ReadFrom(r io.Reader) (n int64, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sr := &snapshotReader{r: bufio.NewReader(r)}
+	h, err := sr.header(t.metricName, t.normName)
+	if err != nil {
+		return sr.n, err
+	}
+
+	f := &Flat{metric: t.metric, seed: h.seed}
+	// Don't trust nnodes for preallocation, the snapshot may be corrupt.
+	for i := uint64(0); i < h.nnodes && sr.err == nil; i++ {
+		n := flatNode{
+			radius:  math.Float64frombits(sr.uint64()),
+			offset:  sr.uint64(),
+			length:  sr.uint32(),
+			inside:  sr.uint32(),
+			outside: sr.uint32(),
+			flags:   sr.uint32(),
+			firstID: sr.uint32(),
+			nids:    sr.uint32(),
+			count:   sr.uint64(),
+		}
+		f.nodes = append(f.nodes, n)
+	}
+	for i := uint64(0); i < h.nids && sr.err == nil; i++ {
+		ref := idRef{offset: sr.uint64(), length: sr.uint32()}
+		sr.uint32()
+		f.idRefs = append(f.idRefs, ref)
+	}
+	f.arena = sr.bytes(h.arenaLen)
+	sr.pad()
+	crc := sr.crc
+	if sum := sr.uint32(); sr.err == nil && sum != crc {
+		return sr.n, errors.New("vp: snapshot checksum mismatch")
+	}
+	if sr.err != nil {
+		return sr.n, sr.err
+	}
+	if err = f.check(); err != nil {
+		return sr.n, err
+	}
+
+	t.root = f.unflatten()
+	t.nelem = f.nelem
+	t.seed = h.seed
+	t.leafSize = h.leafSize
+	t.rng.Seed(h.seed)
+	t.rng.Jump()
+	return sr.n, nil
+}
+
+// LoadFlat returns a Flat for the snapshot in b, which must have been
+// written by WriteTo, with metric m. It returns an error if the names of
+// the metric and normalization stored in the snapshot differ from
+// metricName and normName, or if the snapshot is corrupt.
+//
+// Where possible, the returned Flat uses b as its storage instead of copying
+// it, so b must not be modified afterwards. This makes LoadFlat suitable
+// for use with a memory-mapped file.
+func LoadFlat(b []byte, m Metric[string], metricName, normName string) (*Flat, error) {
+	if len(b) < 4 {
+		return nil, errCorrupt
+	}
+	body := b[:len(b)-4]
+	if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(b[len(body):]) {
+		return nil, errors.New("vp: snapshot checksum mismatch")
+	}
+
+	sr := &snapshotReader{r: bytes.NewReader(body)}
+	h, err := sr.header(metricName, normName)
+	if err != nil {
+		return nil, err
+	}
+	// Checked separately to prevent overflow in the computation of end.
+	if h.nnodes > uint64(len(body)) || h.nids > uint64(len(body)) ||
+		h.arenaLen > uint64(len(body)) {
+		return nil, errCorrupt
+	}
+	start := uint64(sr.n)
+	idStart := start + flatNodeSize*h.nnodes
+	end := idStart + idRefSize*h.nids
+	if end+h.arenaLen > uint64(len(body)) {
+		return nil, errCorrupt
+	}
+
+	f := &Flat{
+		metric:     m,
+		arena:      castString(b[end : end+h.arenaLen]),
+		seed:       h.seed,
+		leafSize:   h.leafSize,
+		metricName: metricName,
+		normName:   normName,
+	}
+
+	nodes, ids := b[start:idStart], b[idStart:end]
+	var cast bool
+	if canCast {
+		f.nodes, cast = castSlice[flatNode](nodes, int(h.nnodes))
+		if cast {
+			f.idRefs, cast = castSlice[idRef](ids, int(h.nids))
+		}
+	}
+	if !cast {
+		le := binary.LittleEndian
+		f.nodes = make([]flatNode, h.nnodes)
+		for i := range f.nodes {
+			rec := nodes[i*flatNodeSize:]
+			f.nodes[i] = flatNode{
+				radius:  math.Float64frombits(le.Uint64(rec)),
+				offset:  le.Uint64(rec[8:]),
+				length:  le.Uint32(rec[16:]),
+				inside:  le.Uint32(rec[20:]),
+				outside: le.Uint32(rec[24:]),
+				flags:   le.Uint32(rec[28:]),
+				firstID: le.Uint32(rec[32:]),
+				nids:    le.Uint32(rec[36:]),
+				count:   le.Uint64(rec[40:]),
+			}
+		}
+		f.idRefs = make([]idRef, h.nids)
+		for i := range f.idRefs {
+			rec := ids[i*idRefSize:]
+			f.idRefs[i] = idRef{offset: le.Uint64(rec), length: le.Uint32(rec[8:])}
+		}
+	}
+
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Checks the structure of f, which has just been read from a snapshot,
+// and computes f.nelem.
+func (f *Flat) check() error {
+	inArena := func(offset uint64, length uint32) bool {
+		return offset <= uint64(len(f.arena)) &&
+			offset+uint64(length) <= uint64(len(f.arena))
+	}
+	for _, ref := range f.idRefs {
+		if !inArena(ref.offset, ref.length) {
+			return errCorrupt
+		}
+	}
+
+	f.nelem = 0
+	for i := range f.nodes {
+		n := &f.nodes[i]
+		if !inArena(n.offset, n.length) || n.count == 0 ||
+			uint64(n.firstID)+uint64(n.nids) > uint64(len(f.idRefs)) {
+			return errCorrupt
+		}
+		if n.flags&flagDeleted == 0 {
+			f.nelem++
+		}
+		if n.flags&flagBucket != 0 {
+			if n.flags&flagInBucket != 0 || n.inside != uint32(i)+1 ||
+				uint64(n.inside)+uint64(n.outside) > uint64(len(f.nodes)) {
+				return errCorrupt
+			}
+			for _, b := range f.nodes[n.inside : n.inside+n.outside] {
+				if b.flags&(flagBucket|flagInBucket) != flagInBucket {
+					return errCorrupt
+				}
+			}
+			continue
+		}
+		for _, j := range [...]uint32{n.inside, n.outside} {
+			if j != 0 && (j <= uint32(i) || int(j) >= len(f.nodes) ||
+				f.nodes[j].flags&flagInBucket != 0) {
+				return errCorrupt
+			}
+		}
+	}
+	return nil
+}
+
+type snapshotHeader struct {
+	seed                   int64
+	leafSize               int
+	nnodes, nids, arenaLen uint64
+}
+
+// Reads a snapshot header, up to and including the padding after it,
+// and checks it against the expected metric and normalization names.
+func (r *snapshotReader) header(metricName, normName string) (h snapshotHeader, err error) {
+	var magic [len(snapshotMagic)]byte
+	r.read(magic[:])
+	if r.err == nil && string(magic[:]) != snapshotMagic {
+		return h, errors.New("vp: not a snapshot")
+	}
+	if v := r.uint32(); r.err == nil && v != snapshotVersion {
+		return h, fmt.Errorf("vp: unsupported snapshot version %d", v)
+	}
+	h.leafSize = int(r.uint32())
+	h.seed = int64(r.uint64())
+	h.nnodes = r.uint64()
+	h.nids = r.uint64()
+	h.arenaLen = r.uint64()
+	if r.err == nil && (h.nnodes > math.MaxUint32 || h.nids > math.MaxUint32) {
+		return h, errCorrupt
+	}
+	metric := r.name()
+	norm := r.name()
+	r.pad()
+
+	switch {
+	case r.err != nil:
+		err = r.err
+	case metric != metricName:
+		err = fmt.Errorf("vp: snapshot has metric %q, want %q",
+			metric, metricName)
+	case norm != normName:
+		err = fmt.Errorf("vp: snapshot has normalization %q, want %q",
+			norm, normName)
+	}
+	return h, err
+}
+
+// snapshotWriter keeps track of the number of bytes written, the checksum
+// and the first error that occurred.
+type snapshotWriter struct {
+	w   *bufio.Writer
+	n   int64
+	crc uint32
+	err error
+	buf [8]byte
+}
+
+func (w *snapshotWriter) write(p []byte) {
+	if w.err != nil {
+		return
+	}
+	var n int
+	n, w.err = w.w.Write(p)
+	w.n += int64(n)
+	w.crc = crc32.Update(w.crc, crcTable, p[:n])
+}
+
+func (w *snapshotWriter) uint32(x uint32) {
+	binary.LittleEndian.PutUint32(w.buf[:4], x)
+	w.write(w.buf[:4])
+}
+
+func (w *snapshotWriter) uint64(x uint64) {
+	binary.LittleEndian.PutUint64(w.buf[:], x)
+	w.write(w.buf[:])
+}
+
+func (w *snapshotWriter) string(s string) {
+	w.uint32(uint32(len(s)))
+	w.write([]byte(s))
+}
+
+// Pad to a multiple of eight bytes.
+func (w *snapshotWriter) pad() {
+	var zero [8]byte
+	w.write(zero[:(8-w.n%8)%8])
+}
+
+// snapshotReader is the counterpart of snapshotWriter.
+type snapshotReader struct {
+	r   io.Reader
+	n   int64
+	crc uint32
+	err error
+	buf [8]byte
+}
+
+func (r *snapshotReader) read(p []byte) {
+	if r.err != nil {
+		return
+	}
+	var n int
+	n, r.err = io.ReadFull(r.r, p)
+	if r.err == io.EOF {
+		r.err = io.ErrUnexpectedEOF
+	}
+	r.n += int64(n)
+	r.crc = crc32.Update(r.crc, crcTable, p[:n])
+}
+
+func (r *snapshotReader) uint32() uint32 {
+	r.read(r.buf[:4])
+	return binary.LittleEndian.Uint32(r.buf[:4])
+}
+
+func (r *snapshotReader) uint64() uint64 {
+	r.read(r.buf[:])
+	return binary.LittleEndian.Uint64(r.buf[:])
+}
+
+// Reads n bytes and returns them as a string.
+func (r *snapshotReader) bytes(n uint64) string {
+	if r.err != nil {
+		return ""
+	}
+	var b strings.Builder
+	_, r.err = io.CopyN(&b, io.TeeReader(r.r, crcWriter{&r.crc}), int64(n))
+	if r.err == io.EOF {
+		r.err = io.ErrUnexpectedEOF
+	}
+	r.n += int64(b.Len())
+	return b.String()
+}
+
+// Reads a length-prefixed name.
+func (r *snapshotReader) name() string {
+	n := r.uint32()
+	if n > maxNameLen && r.err == nil {
+		r.err = errCorrupt
+	}
+	return r.bytes(uint64(n))
+}
+
+func (r *snapshotReader) pad() {
+	var zero [8]byte
+	r.read(zero[:(8-r.n%8)%8])
+}
+
+// crcWriter updates a CRC-32C checksum with what is written to it.
+type crcWriter struct{ crc *uint32 }
+
+func (w crcWriter) Write(p []byte) (int, error) {
+	*w.crc = crc32.Update(*w.crc, crcTable, p)
+	return len(p), nil
+}
@@ -0,0 +1,144 @@
+package vp
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+// Number of bins in the radius histograms of TreeStats.
+const radiusBins = 16
+
+// TreeStats describe the shape of a Tree.
+type TreeStats struct {
+	Nodes     int     `json:"nodes"`
+	Leaves    int     `json:"leaves"`     // Nodes without children.
+	Points    int     `json:"points"`     // Distinct points, including deleted ones.
+	MaxDepth  int     `json:"max_depth"`  // Depth of the root is zero.
+	MeanDepth float64 `json:"mean_depth"` // Mean depth of the points.
+
+	// Histograms of the radii of the nodes with children, one per level of
+	// the tree, starting at the root. All histograms have the same bins:
+	// bin i holds the radii in [i*BinWidth, (i+1)*BinWidth), except that the
+	// last bin also holds the largest radius.
+	BinWidth float64 `json:"bin_width"`
+	Levels   []Level `json:"levels"`
+
+	// Estimate of the memory used by the tree, in bytes. It includes the
+	// contents of strings and slices of points and identifiers, but not
+	// other memory they refer to.
+	Memory int64 `json:"memory_bytes"`
+}
+
+// Level describes the nodes at one level of a Tree.
+type Level struct {
+	Nodes     int     `json:"nodes"`
+	Leaves    int     `json:"leaves"`
+	MinRadius float64 `json:"min_radius"` // Over the nodes with children.
+	MaxRadius float64 `json:"max_radius"`
+	Radii     []int   `json:"radii"` // Histogram of radii.
+}
+
+// Stats returns statistics about the shape of t. It visits every node,
+// so it takes time linear in the size of t.
+func (t *Tree[T]) Stats() TreeStats {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var (
+		st       TreeStats
+		radii    [][]float64 // Per level.
+		depthSum int
+	)
+	var walk func(n *node[T], depth int)
+	walk = func(n *node[T], depth int) {
+		if n == nil {
+			return
+		}
+		if depth == len(st.Levels) {
+			st.Levels = append(st.Levels, Level{})
+			radii = append(radii, nil)
+		}
+		lv := &st.Levels[depth]
+
+		st.Nodes++
+		lv.Nodes++
+		st.Points += 1 + len(n.bucket)
+		depthSum += depth * (1 + len(n.bucket))
+		if depth > st.MaxDepth {
+			st.MaxDepth = depth
+		}
+		st.Memory += nodeMemory(n)
+
+		if n.isLeaf() {
+			st.Leaves++
+			lv.Leaves++
+			return
+		}
+		if len(radii[depth]) == 0 || n.radius < lv.MinRadius {
+			lv.MinRadius = n.radius
+		}
+		if n.radius > lv.MaxRadius {
+			lv.MaxRadius = n.radius
+		}
+		radii[depth] = append(radii[depth], n.radius)
+		walk(n.inside, depth+1)
+		walk(n.outside, depth+1)
+	}
+	walk(t.root, 0)
+
+	if st.Points > 0 {
+		st.MeanDepth = float64(depthSum) / float64(st.Points)
+	}
+
+	var maxRadius float64
+	for _, lv := range st.Levels {
+		if lv.MaxRadius > maxRadius {
+			maxRadius = lv.MaxRadius
+		}
+	}
+	st.BinWidth = maxRadius / radiusBins
+	for depth := range st.Levels {
+		hist := make([]int, radiusBins)
+		for _, r := range radii[depth] {
+			i := radiusBins - 1
+			if st.BinWidth > 0 && r < maxRadius {
+				i = int(r / st.BinWidth)
+			}
+			hist[i]++
+		}
+		st.Levels[depth].Radii = hist
+	}
+	return st
+}
+
+// Estimates the memory used by n, not counting its children.
+func nodeMemory[T any](n *node[T]) int64 {
+	size := int64(unsafe.Sizeof(*n)) + payloadSize(n.center) + idsMemory(n.ids)
+	size += int64(cap(n.bucket)) * int64(unsafe.Sizeof(bucketPoint[T]{}))
+	for i := range n.bucket {
+		b := &n.bucket[i]
+		size += payloadSize(b.p) + idsMemory(b.ids)
+	}
+	return size
+}
+
+func idsMemory(ids []string) int64 {
+	size := int64(cap(ids)) * int64(unsafe.Sizeof(""))
+	for _, id := range ids {
+		size += int64(len(id))
+	}
+	return size
+}
+
+// Returns the size of the memory that p refers to, if it is a string or
+// a slice, or zero.
+func payloadSize[T any](p T) int64 {
+	v := reflect.ValueOf(&p).Elem()
+	switch v.Kind() {
+	case reflect.String:
+		return int64(v.Len())
+	case reflect.Slice:
+		return int64(v.Cap()) * int64(v.Type().Elem().Size())
+	}
+	return 0
+}
@@ -0,0 +1,44 @@
+package vp
+
+import (
+	"context"
+	"math/rand"
+)
+
+// A StringTree is a Tree of strings. In addition to the methods of Tree,
+// it can be flattened and written to and read from snapshots.
+type StringTree struct {
+	*Tree[string]
+}
+
+// NewStrings is like New, but returns a StringTree.
+func NewStrings(ctx context.Context, m Metric[string], points []string) (*StringTree, error) {
+	return NewStringsFromSeed(ctx, m, points, rand.Int63())
+}
+
+// NewStringsFromSeed is like NewFromSeed, but returns a StringTree.
+func NewStringsFromSeed(ctx context.Context, m Metric[string], points []string, seed int64) (*StringTree, error) {
+	t, err := NewFromSeed(ctx, m, points, seed)
+	if err != nil {
+		return nil, err
+	}
+	return &StringTree{t}, nil
+}
+
+// NewStringsWithIDs is like NewWithIDs, but returns a StringTree.
+func NewStringsWithIDs(ctx context.Context, m Metric[string], points, ids []string, seed int64) (*StringTree, error) {
+	t, err := NewWithIDs(ctx, m, points, ids, seed)
+	if err != nil {
+		return nil, err
+	}
+	return &StringTree{t}, nil
+}
+
+// BuildStrings is like Build, but returns a StringTree.
+func BuildStrings(ctx context.Context, m Metric[string], points []string, opts BuildOptions) (*StringTree, error) {
+	t, err := Build(ctx, m, points, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &StringTree{t}, nil
+}
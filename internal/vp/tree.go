@@ -2,39 +2,98 @@
 // structure.
 package vp
 
+import (
+	"reflect"
+	"sync"
+	"unsafe"
+
+	"github.com/knaw-huc/levenserv/internal/tinyrng"
+)
+
 // A Metric is a function m that satisfies the metric axioms.
 //
 // It is assumed that a metric can be called by multiple goroutines
 // concurrently.
-type Metric func(a, b string) float64
+type Metric[T any] func(a, b T) float64
 
-// A Tree is an index structure for strings that allows nearest-neighbor
-// and radius queries.
-type Tree struct {
-	metric Metric
+// A Tree is an index structure for items of type T that allows
+// nearest-neighbor and radius queries. T is typically a string, but may be
+// any representation of the items that the metric can compare efficiently,
+// such as a slice of runes or a set of trigrams.
+//
+// The methods of a Tree may be called from multiple goroutines concurrently.
+type Tree[T any] struct {
+	mu     sync.RWMutex // Protects the fields below against Insert and Delete.
+	metric Metric[T]
+	less   func(a, b T) bool // Order among points at equal distances; may be nil.
 	nelem  int
-	root   *node
+	root   *node[T]
+	rng    tinyrng.Xoroshiro128 // For rebuilding subtrees after Delete.
+	seed   int64
+
+	workers  int // Maximum number of goroutines for rebuilding.
+	leafSize int // Maximum number of points in a bucket, or zero.
+
+	// Names of the metric and the normalization applied to the points,
+	// for snapshots.
+	metricName, normName string
 }
 
-type node struct {
-	center  string
-	inside  *node
-	outside *node
+type node[T any] struct {
+	center  T
+	ids     []string // Identifiers associated with center.
+	count   int      // Number of occurrences of center.
+	inside  *node[T]
+	outside *node[T]
 	radius  float64
+
+	// Points of a leaf other than center, with their distances to center.
+	// Only nodes without children have a bucket.
+	bucket []bucketPoint[T]
+
+	// A deleted node is not reported by searches, but its center
+	// is still used as a vantage point.
+	deleted bool
+	size    int // Number of points in the subtree rooted here.
+	ndel    int // Number of deleted points in the subtree rooted here.
+}
+
+// A bucketPoint is a point in the bucket of a leaf. Its d is the distance
+// to the center of the leaf.
+type bucketPoint[T any] struct {
+	pointDist[T]
+	deleted bool
 }
 
 // Do calls f on each item in the tree t, in some unspecified order,
 // until f returns false.
-func (t *Tree) Do(f func(string) bool) {
+func (t *Tree[T]) Do(f func(T) bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
 	t.root.do(f)
 }
 
-func (n *node) do(f func(string) bool) bool {
+func (n *node[T]) do(f func(T) bool) bool {
+	return n.doPoints(func(p *pointDist[T]) bool { return f(p.p) })
+}
+
+// Calls f on each point that has not been deleted, including the points
+// in buckets. The d of the points passed to f is meaningless.
+func (n *node[T]) doPoints(f func(*pointDist[T]) bool) bool {
 	for n != nil {
-		if !f(n.center) {
-			return false
+		if !n.deleted {
+			p := pointDist[T]{p: n.center, ids: n.ids, count: n.count}
+			if !f(&p) {
+				return false
+			}
+		}
+		for i := range n.bucket {
+			if b := &n.bucket[i]; !b.deleted && !f(&b.pointDist) {
+				return false
+			}
 		}
-		if !n.inside.do(f) {
+		if !n.inside.doPoints(f) {
 			return false
 		}
 		n = n.outside
@@ -42,16 +101,39 @@ func (n *node) do(f func(string) bool) bool {
 	return true
 }
 
-// Len reports the number of elements in t.
-func (t *Tree) Len() int {
-	return t.root.len()
+// Reports whether n has no children.
+func (n *node[T]) isLeaf() bool { return n.inside == nil && n.outside == nil }
+
+// Number of points in the subtree rooted at n.
+func sizeOf[T any](n *node[T]) int {
+	if n == nil {
+		return 0
+	}
+	return n.size
 }
 
-func (n *node) len() int {
-	num := 0
-	for n != nil {
-		num += 1 + n.inside.len()
-		n = n.outside
+// Len reports the number of distinct elements in t.
+func (t *Tree[T]) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.nelem
+}
+
+// Returns the lexicographic order on T if T is a string type, or nil if it
+// is not. Trees of other types produce points at equal distances in an
+// unspecified order.
+func lessFunc[T any]() func(a, b T) bool {
+	if reflect.TypeOf((*T)(nil)).Elem().Kind() != reflect.String {
+		return nil
 	}
-	return num
+	return func(a, b T) bool {
+		return *(*string)(unsafe.Pointer(&a)) < *(*string)(unsafe.Pointer(&b))
+	}
+}
+
+// Reports whether a and b are equal. Since equal points are at distance
+// zero, callers should check the distance first.
+func equal[T any](a, b T) bool {
+	return reflect.DeepEqual(a, b)
 }
@@ -0,0 +1,185 @@
+package vp
+
+import (
+	"context"
+	"math"
+)
+
+// Insert adds the point s to t, with the identifiers ids.
+//
+// Insert descends from the root along the path that a search for s would
+// try first and attaches s as a new leaf at the end of that path, or adds
+// it to the bucket of the leaf there if t has buckets. A full bucket is
+// split by rebuilding the leaf. The tree is not rebalanced, so a large
+// number of insertions may make searches slower than they would be on a
+// tree built by New from the same points.
+// If s already occurs in t, its count is incremented and the identifiers
+// are added to those of the existing point instead.
+//
+// Insert blocks concurrent calls to Search, Do and Len while it runs.
+// It may be stopped by canceling ctx, in which case ctx.Err() is returned
+// and t is left unchanged. If ctx is nil, context.Background() is used.
+func (t *Tree[T]) Insert(ctx context.Context, s T, ids ...string) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	done := ctx.Done()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if oldIDs, count := t.find(t.root, s); count != nil {
+		*count++
+		if len(ids) > 0 {
+			// Reallocate, since searches may have returned the old slice.
+			*oldIDs = append((*oldIDs)[:len(*oldIDs):len(*oldIDs)], ids...)
+		}
+		return nil
+	}
+
+	var path []*node[T]
+	p := &t.root
+	for *p != nil {
+		select {
+		case <-done:
+			return ctx.Err()
+		default:
+		}
+
+		n := *p
+		d := t.metric(s, n.center)
+		if t.leafSize > 0 && n.isLeaf() {
+			t.insertLeaf(p, path, pointDist[T]{p: s, ids: ids, count: 1, d: d})
+			t.nelem++
+			return nil
+		}
+
+		path = append(path, n)
+		switch {
+		case math.IsNaN(n.radius):
+			// Singleton. Make s its inside child, at exactly the radius.
+			n.radius = d
+			p = &n.inside
+		case d < n.radius:
+			p = &n.inside
+		default:
+			p = &n.outside
+		}
+	}
+
+	*p = singleton(pointDist[T]{p: s, ids: ids, count: 1}, &node[T]{})
+	for _, n := range path {
+		n.size++
+	}
+	t.nelem++
+	return nil
+}
+
+// Adds p to the bucket of the leaf *l, or replaces *l by a new subtree
+// if the bucket is full. The ancestors of *l are in path.
+func (t *Tree[T]) insertLeaf(l **node[T], path []*node[T], p pointDist[T]) {
+	n := *l
+	nremoved := 0
+	if len(n.bucket) < t.leafSize {
+		n.bucket = append(n.bucket, bucketPoint[T]{pointDist: p})
+		n.size++
+	} else {
+		// Rebuilding drops the deleted points.
+		nremoved = n.ndel
+		*l = t.rebuild(n, p)
+	}
+	for _, a := range path {
+		a.size += 1 - nremoved
+		a.ndel -= nremoved
+	}
+}
+
+// Returns pointers to the identifiers and the count of the point s in the
+// subtree n, if s occurs there and has not been deleted, or nils otherwise.
+func (t *Tree[T]) find(n *node[T], s T) (ids *[]string, count *int) {
+	if n == nil {
+		return nil, nil
+	}
+
+	d := t.metric(s, n.center)
+	if !n.deleted && d == 0 && equal(n.center, s) {
+		return &n.ids, &n.count
+	}
+	for i := range n.bucket {
+		if b := &n.bucket[i]; !b.deleted && equal(b.p, s) {
+			return &b.ids, &b.count
+		}
+	}
+	// Points at exactly the radius may be on either side.
+	if d <= n.radius {
+		ids, count = t.find(n.inside, s)
+	}
+	if count == nil && d >= n.radius {
+		ids, count = t.find(n.outside, s)
+	}
+	return ids, count
+}
+
+// Subtrees in which more than this fraction of the points have been
+// deleted are rebuilt by Delete.
+const maxDeletedFraction = .25
+
+// Delete removes all occurrences of the point s from t and reports whether
+// s occurred in t.
+//
+// Deleted points are not removed from the tree immediately, since they
+// may be the vantage point for other points. Instead, they are marked as
+// deleted, and Delete rebuilds subtrees in which the fraction of deleted
+// points grows too large.
+//
+// Delete blocks concurrent calls to Search, Do and Len while it runs.
+func (t *Tree[T]) Delete(s T) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ndel, _ := t.delete(&t.root, s)
+	t.nelem -= ndel
+	return ndel > 0
+}
+
+// Deletes s from the subtree *p, replacing it if it needs to be rebuilt.
+// Returns the number of points deleted and the number of points removed
+// by rebuilding.
+func (t *Tree[T]) delete(p **node[T], s T) (ndel, nremoved int) {
+	n := *p
+	if n == nil {
+		return 0, 0
+	}
+
+	d := t.metric(s, n.center)
+	if !n.deleted && d == 0 && equal(n.center, s) {
+		n.deleted = true
+		ndel++
+	}
+	for i := range n.bucket {
+		if b := &n.bucket[i]; !b.deleted && equal(b.p, s) {
+			b.deleted = true
+			ndel++
+		}
+	}
+	// Points at exactly the radius may be on either side.
+	if d <= n.radius {
+		del, rem := t.delete(&n.inside, s)
+		ndel, nremoved = ndel+del, nremoved+rem
+	}
+	if d >= n.radius {
+		del, rem := t.delete(&n.outside, s)
+		ndel, nremoved = ndel+del, nremoved+rem
+	}
+
+	if ndel == 0 {
+		return 0, 0
+	}
+	n.ndel += ndel - nremoved
+	n.size -= nremoved
+	if float64(n.ndel) > maxDeletedFraction*float64(n.size) {
+		nremoved += n.ndel
+		*p = t.rebuild(n)
+	}
+	return ndel, nremoved
+}
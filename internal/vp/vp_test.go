@@ -1,7 +1,9 @@
 package vp_test
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"math"
 	"math/rand"
 	"reflect"
@@ -14,7 +16,7 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func countingLevenshtein() (vp.Metric, *uint64) {
+func countingLevenshtein() (vp.Metric[string], *uint64) {
 	count := new(uint64)
 	m := func(a, b string) float64 {
 		atomic.AddUint64(count, 1)
@@ -26,32 +28,41 @@ func countingLevenshtein() (vp.Metric, *uint64) {
 func TestLevenshtein(t *testing.T) {
 	var (
 		seeds      = []int64{1, 17, 19, 24}
-		totalCalls uint64
+		totalCalls = make(map[string]uint64)
 	)
 
 	for _, seed := range seeds {
 		m, count := countingLevenshtein()
-		tree, _ := vp.NewFromSeed(nil, m, words, seed)
+		vpTree, _ := vp.NewFromSeed(nil, m, words, seed)
+		mvpTree, _ := vp.NewMVP(nil, m, words, vp.BuildOptions{Seed: seed})
 
-		if !assert.Equal(t, len(words), tree.Len()) {
-			return
-		}
-
-		*count = 0
-
-		const k = 10
-		for _, q := range queryWords {
-			nn, _ := tree.Search(nil, q, k, math.Inf(+1), nil)
-			if !assert.Equal(t, k, len(nn)) ||
-				!assert.Equal(t, q, nn[0].Point) ||
-				!assert.Zero(t, nn[0].Dist) {
+		for name, tree := range map[string]searchTree{
+			"vp": vpTree, "mvp": mvpTree,
+		} {
+			if !assert.Equal(t, len(words), tree.Len(), name) {
 				return
 			}
-			for _, r := range nn {
-				assert.Equal(t, m(r.Point, q), r.Dist)
+
+			*count = 0
+
+			const k = 10
+			for _, q := range queryWords {
+				var stats vp.Stats
+				before := *count
+				nn, _ := tree.SearchWith(nil, q, k, math.Inf(+1), nil,
+					vp.Options{Stats: &stats})
+				if !assert.Equal(t, int(*count-before), stats.DistCalls, name) ||
+					!assert.Equal(t, k, len(nn), name) ||
+					!assert.Equal(t, q, nn[0].Point, name) ||
+					!assert.Zero(t, nn[0].Dist, name) {
+					return
+				}
+				for _, r := range nn {
+					assert.Equal(t, m(r.Point, q), r.Dist)
+				}
 			}
+			totalCalls[name] += *count
 		}
-		totalCalls += *count
 	}
 
 	// We want to perform at most .6 times the number of calls compared to
@@ -60,7 +71,20 @@ func TestLevenshtein(t *testing.T) {
 
 	bruteForce := (float64(len(words)) * float64(len(queryWords)) *
 		float64(len(seeds)))
-	assert.Less(t, totalCalls, uint64(fraction*bruteForce))
+	assert.Less(t, totalCalls["vp"], uint64(fraction*bruteForce))
+
+	// The MVP-tree should do better than the VP-tree.
+	assert.Less(t, totalCalls["mvp"], totalCalls["vp"])
+	t.Logf("distance calls: vp %d, mvp %d, brute force %.0f",
+		totalCalls["vp"], totalCalls["mvp"], bruteForce)
+}
+
+// searchTree is the part of the API shared by Tree and MVPTree.
+type searchTree interface {
+	Do(func(string) bool)
+	Len() int
+	Range(context.Context, string, float64, vp.Predicate[string]) ([]vp.Result[string], error)
+	SearchWith(context.Context, string, int, float64, vp.Predicate[string], vp.Options) ([]vp.Result[string], error)
 }
 
 func TestLevenshteinSmall(t *testing.T) {
@@ -72,6 +96,32 @@ func TestLevenshteinSmall(t *testing.T) {
 	}
 }
 
+func TestBuildWorkers(t *testing.T) {
+	m := func(a, b string) float64 {
+		return float64(levenshtein.DistanceCodepoints(a, b))
+	}
+
+	var expect []byte
+	for _, workers := range []int{1, 2, 8, 0} {
+		tree, err := vp.BuildStrings(nil, m, words, vp.BuildOptions{
+			Seed:    77,
+			Workers: workers,
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		// The snapshot captures the entire structure of the tree.
+		var buf bytes.Buffer
+		tree.WriteTo(&buf)
+		if expect == nil {
+			expect = buf.Bytes()
+			continue
+		}
+		assert.Equal(t, expect, buf.Bytes(), "%d workers", workers)
+	}
+}
+
 func TestDo(t *testing.T) {
 	m := func(a, b string) float64 {
 		return float64(levenshtein.DistanceCodepoints(a, b))
@@ -97,6 +147,1228 @@ func TestDo(t *testing.T) {
 	}
 }
 
+func TestInsert(t *testing.T) {
+	m := func(a, b string) float64 {
+		return float64(levenshtein.DistanceCodepoints(a, b))
+	}
+	half := len(words) / 2
+	tree, _ := vp.NewFromSeed(nil, m, words[:half], 31)
+
+	// Search concurrently with the insertions, to give the race detector
+	// something to do.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, q := range queryWords {
+			tree.Search(nil, q, 3, math.Inf(+1), nil)
+		}
+	}()
+
+	for i, w := range words[half:] {
+		if err := tree.Insert(nil, w); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, half+i+1, tree.Len())
+	}
+	<-done
+
+	for _, q := range words {
+		nn, _ := tree.Search(nil, q, 1, math.Inf(+1), nil)
+		if !assert.Len(t, nn, 1) || !assert.Equal(t, q, nn[0].Point) {
+			return
+		}
+	}
+
+	empty, _ := vp.New(nil, m, nil)
+	empty.Insert(nil, "foo")
+	empty.Insert(nil, "bar")
+	assert.Equal(t, 2, empty.Len())
+	nn, _ := empty.Search(nil, "baz", 2, math.Inf(+1), nil)
+	assert.Equal(t, []vp.Result[string]{{Point: "bar", Dist: 1, Count: 1}, {Point: "foo", Dist: 3, Count: 1}}, nn)
+}
+
+func TestDelete(t *testing.T) {
+	m := func(a, b string) float64 {
+		return float64(levenshtein.DistanceCodepoints(a, b))
+	}
+	tree, _ := vp.NewFromSeed(nil, m, words, 8)
+
+	var kept []string
+	for i, w := range words {
+		if i%3 != 0 {
+			kept = append(kept, w)
+			continue
+		}
+		if !tree.Delete(w) {
+			t.Fatalf("%q not deleted", w)
+		}
+	}
+	assert.False(t, tree.Delete(words[0]))
+	assert.Equal(t, len(kept), tree.Len())
+
+	var done []string
+	tree.Do(func(s string) bool {
+		done = append(done, s)
+		return true
+	})
+	assert.ElementsMatch(t, kept, done)
+
+	for i := 0; i < len(words); i += 5 {
+		q := words[i]
+		nn, _ := tree.Search(nil, q, 1, math.Inf(+1), nil)
+		if i%3 != 0 {
+			assert.Equal(t, q, nn[0].Point)
+			continue
+		}
+
+		best := math.Inf(+1)
+		for _, w := range kept {
+			best = math.Min(best, m(q, w))
+		}
+		assert.Equal(t, best, nn[0].Dist, "nearest neighbor of %q", q)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	m := func(a, b string) float64 {
+		return float64(levenshtein.DistanceCodepoints(a, b))
+	}
+	tree, _ := vp.NewStringsFromSeed(nil, m, words, 42)
+	tree.SetNames("levenshtein", "nfc")
+	for _, w := range words[:10] {
+		tree.Delete(w)
+	}
+
+	var buf bytes.Buffer
+	n, err := tree.WriteTo(&buf)
+	if !assert.NoError(t, err) || !assert.Equal(t, int64(buf.Len()), n) {
+		return
+	}
+	snapshot := buf.Bytes()
+
+	loaded, _ := vp.NewStrings(nil, m, nil)
+	loaded.SetNames("levenshtein", "nfc")
+	n, err = loaded.ReadFrom(bytes.NewReader(snapshot))
+	if !assert.NoError(t, err) || !assert.Equal(t, int64(len(snapshot)), n) {
+		return
+	}
+	assert.Equal(t, tree.Len(), loaded.Len())
+
+	for _, q := range queryWords {
+		expect, _ := tree.Search(nil, q, 5, math.Inf(+1), nil)
+		got, _ := loaded.Search(nil, q, 5, math.Inf(+1), nil)
+		assert.Equal(t, expect, got)
+	}
+	assert.False(t, loaded.Delete(words[0]))
+	assert.True(t, loaded.Delete(words[10]))
+
+	other, _ := vp.NewStrings(nil, m, nil)
+	other.SetNames("levenshtein", "nfd")
+	_, err = other.ReadFrom(bytes.NewReader(snapshot))
+	assert.Error(t, err)
+
+	other.SetNames("levenshtein", "nfc")
+	snapshot[len(snapshot)/2] ^= 1
+	_, err = other.ReadFrom(bytes.NewReader(snapshot))
+	assert.Error(t, err)
+	_, err = other.ReadFrom(bytes.NewReader(snapshot[:100]))
+	assert.Error(t, err)
+	assert.Zero(t, other.Len())
+}
+
+func TestFlat(t *testing.T) {
+	m := func(a, b string) float64 {
+		return float64(levenshtein.DistanceCodepoints(a, b))
+	}
+	tree, _ := vp.NewStringsFromSeed(nil, m, words, 7)
+	tree.SetNames("levenshtein", "")
+	for _, w := range words[:10] {
+		tree.Delete(w)
+	}
+	flat := tree.Flatten()
+
+	var buf bytes.Buffer
+	tree.WriteTo(&buf)
+	mapped, err := vp.LoadFlat(buf.Bytes(), m, "levenshtein", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	// Force a misaligned copy.
+	misaligned := make([]byte, buf.Len()+1)[1:]
+	copy(misaligned, buf.Bytes())
+	copied, err := vp.LoadFlat(misaligned, m, "levenshtein", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = vp.LoadFlat(buf.Bytes(), m, "levenshtein_bytes", "")
+	assert.Error(t, err)
+
+	var all []string
+	tree.Do(func(s string) bool {
+		all = append(all, s)
+		return true
+	})
+
+	for _, f := range []*vp.Flat{flat, mapped, copied} {
+		assert.Equal(t, tree.Len(), f.Len())
+
+		var done []string
+		f.Do(func(s string) bool {
+			done = append(done, s)
+			return true
+		})
+		assert.ElementsMatch(t, all, done)
+
+		for _, q := range queryWords {
+			expect, _ := tree.Search(nil, q, 5, math.Inf(+1), nil)
+			got, _ := f.Search(nil, q, 5, math.Inf(+1), nil)
+			assert.Equal(t, expect, got)
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	m := func(a, b string) float64 {
+		return float64(levenshtein.DistanceCodepoints(a, b))
+	}
+	tree, _ := vp.NewFromSeed(nil, m, words, 5)
+
+	for _, radius := range []float64{0, 2, 10} {
+		for _, q := range queryWords[:20] {
+			var expect []string
+			for _, w := range words {
+				if m(q, w) <= radius {
+					expect = append(expect, w)
+				}
+			}
+
+			rs, _ := tree.Range(nil, q, radius, nil)
+			var got []string
+			for i, r := range rs {
+				got = append(got, r.Point)
+				if i > 0 {
+					assert.LessOrEqual(t, rs[i-1].Dist, r.Dist)
+				}
+			}
+			assert.ElementsMatch(t, expect, got, "radius %g around %q", radius, q)
+		}
+	}
+}
+
+func TestRangeLimit(t *testing.T) {
+	m, count := countingLevenshtein()
+	tree, _ := vp.NewFromSeed(nil, m, words, 5)
+
+	// A range search with a limit, as /range does it, must not cost more
+	// than one without, nor more than a search without a radius: once it
+	// has enough results, only nearer points matter.
+	for _, k := range []int{1, 3} {
+		for _, w := range words[:200] {
+			q := w + "s"
+			*count = 0
+			nn, _ := tree.Search(nil, q, k, math.Inf(+1), nil)
+			unbounded := int(*count)
+
+			radius := nn[k-1].Dist + 2
+			*count = 0
+			all, _ := tree.Range(nil, q, radius, nil)
+			unlimited := int(*count)
+
+			var stats vp.Stats
+			limited, _ := tree.SearchWith(nil, q, k, radius, nil, vp.Options{Stats: &stats})
+			assert.LessOrEqual(t, stats.DistCalls, unlimited, "query %q", q)
+			assert.LessOrEqual(t, stats.DistCalls, unbounded, "query %q", q)
+			assert.Len(t, limited, k)
+			for i := range limited {
+				assert.Equal(t, all[i].Dist, limited[i].Dist)
+			}
+		}
+	}
+}
+
+func TestNearest(t *testing.T) {
+	m := func(a, b string) float64 {
+		return float64(levenshtein.DistanceCodepoints(a, b))
+	}
+	tree, _ := vp.NewStringsFromSeed(nil, m, words, 3)
+	flat := tree.Flatten()
+
+	for _, q := range queryWords[:10] {
+		var expect []vp.Result[string]
+		for _, w := range words {
+			expect = append(expect, vp.Result[string]{Point: w, Dist: m(q, w), Count: 1})
+		}
+		sort.Slice(expect, func(i, j int) bool {
+			x, y := &expect[i], &expect[j]
+			return x.Dist < y.Dist || x.Dist == y.Dist && x.Point < y.Point
+		})
+
+		for _, it := range []*vp.Iterator[string]{tree.Nearest(nil, q), flat.Nearest(nil, q)} {
+			for i := 0; i < 100; i++ {
+				r, ok := it.Next()
+				if !assert.True(t, ok) || !assert.Equal(t, expect[i], r) {
+					break
+				}
+			}
+		}
+	}
+
+	it := tree.Nearest(nil, "foo")
+	n := 0
+	for _, ok := it.Next(); ok; _, ok = it.Next() {
+		n++
+	}
+	assert.Equal(t, len(words), n)
+	assert.NoError(t, it.Err())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	it = tree.Nearest(ctx, "foo")
+	cancel()
+	_, ok := it.Next()
+	assert.False(t, ok)
+	assert.Equal(t, context.Canceled, it.Err())
+}
+
+func TestIDs(t *testing.T) {
+	m := func(a, b string) float64 {
+		return float64(levenshtein.DistanceCodepoints(a, b))
+	}
+	points := []string{"foo", "bar", "foo", "baz", "quux", "bar", "foo"}
+	ids := []string{"1", "2", "3", "4", "5", "6", "7"}
+	tree, _ := vp.NewStringsWithIDs(nil, m, points, ids, 1)
+	assert.Equal(t, 4, tree.Len())
+
+	tree.Insert(nil, "baz", "8")
+	tree.Insert(nil, "quuux", "9")
+	assert.Equal(t, 5, tree.Len())
+
+	var buf bytes.Buffer
+	tree.WriteTo(&buf)
+	flat, _ := vp.LoadFlat(buf.Bytes(), m, "", "")
+
+	expect := map[string][]string{
+		"foo": {"1", "3", "7"}, "bar": {"2", "6"}, "baz": {"4", "8"},
+		"quux": {"5"}, "quuux": {"9"},
+	}
+	for q, ids := range expect {
+		nn, _ := tree.Search(nil, q, 1, 0, nil)
+		assert.Equal(t, []vp.Result[string]{{Point: q, Count: len(ids), IDs: ids}}, nn)
+
+		for _, f := range []*vp.Flat{tree.Flatten(), flat} {
+			nn, _ = f.Search(nil, q, 1, 0, nil)
+			assert.Equal(t, []vp.Result[string]{{Point: q, Count: len(ids), IDs: ids}}, nn)
+
+			r, _ := f.Nearest(nil, q).Next()
+			assert.Equal(t, ids, r.IDs)
+		}
+	}
+
+	// An empty identifier stands for none.
+	tree, _ = vp.NewStringsWithIDs(nil, m, []string{"foo", "foo"}, []string{"", "1"}, 1)
+	nn, _ := tree.Search(nil, "foo", 1, 0, nil)
+	assert.Equal(t, []vp.Result[string]{{Point: "foo", Count: 2, IDs: []string{"1"}}}, nn)
+
+	tree, _ = vp.NewStringsWithIDs(nil, m, []string{"bar", "baz"}, []string{"10", "9"}, 1)
+	numeric := func(a, b string) bool { return len(a) < len(b) || len(a) == len(b) && a < b }
+	for _, c := range []struct {
+		less   func(a, b string) bool
+		expect string
+	}{{nil, "bar"}, {numeric, "baz"}} {
+		opts := vp.Options{Ties: vp.ByID, IDLess: c.less}
+		nn, _ = tree.SearchWith(nil, "bax", 1, math.Inf(+1), nil, opts)
+		assert.Equal(t, c.expect, nn[0].Point)
+	}
+}
+
+func TestLeaves(t *testing.T) {
+	m := func(a, b string) float64 {
+		return float64(levenshtein.DistanceCodepoints(a, b))
+	}
+	half := len(words) / 2
+
+	for _, leafSize := range []int{1, 4, 16} {
+		tree, _ := vp.BuildStrings(nil, m, words[:half], vp.BuildOptions{
+			Seed:     int64(leafSize),
+			LeafSize: leafSize,
+		})
+		for _, w := range words[half:] {
+			tree.Insert(nil, w)
+		}
+		for _, w := range words[:half/4] {
+			tree.Delete(w)
+		}
+		kept := words[half/4:]
+		if !assert.Equal(t, len(kept), tree.Len()) {
+			return
+		}
+
+		var buf bytes.Buffer
+		tree.WriteTo(&buf)
+		flat, err := vp.LoadFlat(buf.Bytes(), m, "", "")
+		if !assert.NoError(t, err) {
+			return
+		}
+		loaded, _ := vp.NewStrings(nil, m, nil)
+		_, err = loaded.ReadFrom(bytes.NewReader(buf.Bytes()))
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, len(kept), flat.Len())
+		assert.Equal(t, len(kept), loaded.Len())
+
+		var skipped int
+		for _, q := range queryWords[:20] {
+			var expect []float64
+			for _, w := range kept {
+				if d := m(q, w); d <= 2 {
+					expect = append(expect, d)
+				}
+			}
+			sort.Float64s(expect)
+
+			var stats vp.Stats
+			nn, _ := tree.SearchWith(nil, q, 5, math.Inf(+1), nil,
+				vp.Options{Stats: &stats})
+			skipped += stats.Skipped
+			rs, _ := flat.Range(nil, q, 2, nil)
+			it := loaded.Nearest(nil, q)
+			for i := range expect {
+				if i < len(nn) {
+					assert.Equal(t, expect[i], nn[i].Dist, "leaf size %d", leafSize)
+				}
+				r, _ := it.Next()
+				assert.Equal(t, expect[i], r.Dist, "leaf size %d", leafSize)
+			}
+			assert.Len(t, rs, len(expect))
+		}
+		assert.NotZero(t, skipped)
+	}
+}
+
+func TestMVP(t *testing.T) {
+	m := func(a, b string) float64 {
+		return float64(levenshtein.DistanceCodepoints(a, b))
+	}
+
+	for _, size := range []int{0, 1, 2, 3, 20, len(words)} {
+		points := append(words[:size:size], words[:size/2]...)
+		tree, err := vp.NewMVP(nil, m, points, vp.BuildOptions{
+			IDs:  points,
+			Seed: int64(size),
+		})
+		if !assert.NoError(t, err) || !assert.Equal(t, size, tree.Len()) {
+			return
+		}
+
+		var done []string
+		tree.Do(func(s string) bool {
+			done = append(done, s)
+			return true
+		})
+		all := append([]string(nil), words[:size]...)
+		sort.Strings(done)
+		sort.Strings(all)
+		assert.Equal(t, all, done)
+
+		for _, q := range queryWords[:10] {
+			var expect []float64
+			for _, w := range words[:size] {
+				if d := m(q, w); d <= 3 {
+					expect = append(expect, d)
+				}
+			}
+			sort.Float64s(expect)
+
+			rs, _ := tree.Range(nil, q, 3, nil)
+			if !assert.Len(t, rs, len(expect)) {
+				continue
+			}
+			for i, r := range rs {
+				assert.Equal(t, expect[i], r.Dist)
+				count := 1
+				for _, w := range points[size:] {
+					if w == r.Point {
+						count++
+					}
+				}
+				assert.Equal(t, count, r.Count)
+				assert.Len(t, r.IDs, count)
+			}
+
+			nn, _ := tree.Search(nil, q, 3, math.Inf(+1), nil)
+			for i := range nn {
+				if i < len(expect) {
+					assert.Equal(t, expect[i], nn[i].Dist)
+				}
+			}
+		}
+	}
+
+	linear := vp.NewLinear(m, words, nil)
+	for _, fanout := range []int{3, 5} {
+		tree, _ := vp.NewMVP(nil, m, words, vp.BuildOptions{Seed: 4, Fanout: fanout})
+		for _, q := range queryWords[:10] {
+			expect, _ := linear.Search(nil, q, 5, math.Inf(+1), nil)
+			nn, _ := tree.Search(nil, q, 5, math.Inf(+1), nil)
+			if !assert.Len(t, nn, len(expect), "fanout %d", fanout) {
+				continue
+			}
+			for i := range nn {
+				assert.Equal(t, expect[i].Dist, nn[i].Dist, "fanout %d", fanout)
+			}
+		}
+	}
+}
+
+func TestLinear(t *testing.T) {
+	m, count := countingLevenshtein()
+	tree, _ := vp.NewFromSeed(nil, m, words, 3)
+	// Repeat the query words to test counting.
+	linear := vp.NewLinear(m, append(words[:len(words):len(words)], queryWords...), nil)
+	assert.Equal(t, tree.Len(), linear.Len())
+
+	n := 0
+	linear.Do(func(string) bool { n++; return true })
+	assert.Equal(t, len(words), n)
+
+	for _, q := range queryWords {
+		var stats vp.Stats
+		*count = 0
+		got, _ := linear.SearchWith(nil, q, 5, math.Inf(+1), nil,
+			vp.Options{Stats: &stats})
+		assert.Equal(t, len(words), int(*count))
+		assert.Equal(t, len(words), stats.DistCalls)
+
+		expect, _ := tree.Search(nil, q, 5, math.Inf(+1), nil)
+		if !assert.Len(t, got, len(expect)) {
+			return
+		}
+		for i := range got {
+			assert.Equal(t, expect[i].Dist, got[i].Dist)
+		}
+		assert.Equal(t, q, got[0].Point)
+		assert.Equal(t, 2, got[0].Count)
+
+		got, _ = linear.Range(nil, q, 3, nil)
+		expect, _ = tree.Range(nil, q, 3, nil)
+		assert.Len(t, got, len(expect))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := linear.Search(ctx, "foo", 1, math.Inf(+1), nil)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestSharded(t *testing.T) {
+	m := func(a, b string) float64 {
+		return float64(levenshtein.DistanceCodepoints(a, b))
+	}
+	points := append(words[:len(words):len(words)], queryWords...)
+	linear := vp.NewLinear(m, points, nil)
+
+	for _, n := range []int{1, 3, 8} {
+		sh, err := vp.NewSharded(nil, m, points, n, vp.BuildOptions{Seed: 5})
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, n, sh.Shards())
+		assert.Equal(t, len(words), sh.Len())
+
+		seen := make(map[string]bool)
+		sh.Do(func(s string) bool {
+			seen[s] = true
+			return true
+		})
+		assert.Len(t, seen, len(words))
+
+		for _, q := range queryWords {
+			for _, ties := range []vp.TieBreak{vp.AnyOrder, vp.ByFrequency} {
+				var stats vp.Stats
+				got, _ := sh.SearchWith(nil, q+"s", 4, math.Inf(+1), nil,
+					vp.Options{Stats: &stats, Ties: ties})
+				expect, _ := linear.SearchWith(nil, q+"s", 4, math.Inf(+1), nil,
+					vp.Options{Ties: ties})
+				if !assert.Len(t, got, len(expect)) {
+					return
+				}
+				for i := range got {
+					assert.Equal(t, expect[i].Dist, got[i].Dist)
+					if ties == vp.ByFrequency {
+						assert.Equal(t, expect[i].Count, got[i].Count)
+					}
+				}
+				assert.Less(t, stats.DistCalls, len(words))
+			}
+
+			got, _ := sh.Range(nil, q, 2, nil)
+			expect, _ := linear.Range(nil, q, 2, nil)
+			assert.Len(t, got, len(expect))
+		}
+	}
+
+	sh, _ := vp.NewSharded(nil, m, words, 4, vp.BuildOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := sh.Search(ctx, "foo", 1, math.Inf(+1), nil)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestSegmented(t *testing.T) {
+	m := func(a, b string) float64 {
+		return float64(levenshtein.DistanceCodepoints(a, b))
+	}
+	seg, err := vp.NewSegmented(nil, m, words[:500], 16, vp.BuildOptions{Seed: 8})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Search concurrently with the updates.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			seg.Search(nil, queryWords[i%len(queryWords)], 3, math.Inf(+1), nil)
+		}
+	}()
+
+	counts := make(map[string]int)
+	for _, w := range words[:500] {
+		counts[w]++
+	}
+	r := rand.New(rand.NewSource(8))
+	for i := 0; i < 3000; i++ {
+		w := words[r.Intn(len(words))]
+		if r.Intn(4) == 0 {
+			assert.Equal(t, counts[w] > 0, seg.Delete(w))
+			delete(counts, w)
+			continue
+		}
+		seg.Insert(nil, w)
+		counts[w]++
+	}
+	<-done
+	seg.Wait()
+	assert.Equal(t, len(counts), seg.Len())
+	assert.Less(t, seg.Segments(), 12)
+
+	var points []string
+	for w, n := range counts {
+		for i := 0; i < n; i++ {
+			points = append(points, w)
+		}
+	}
+	linear := vp.NewLinear(m, points, nil)
+
+	seen := make(map[string]bool)
+	seg.Do(func(s string) bool {
+		assert.False(t, seen[s], s)
+		seen[s] = true
+		return true
+	})
+	assert.Len(t, seen, len(counts))
+
+	for _, q := range queryWords {
+		got, _ := seg.SearchWith(nil, q, 5, math.Inf(+1), nil,
+			vp.Options{Ties: vp.ByFrequency})
+		expect, _ := linear.SearchWith(nil, q, 5, math.Inf(+1), nil,
+			vp.Options{Ties: vp.ByFrequency})
+		if !assert.Len(t, got, len(expect)) {
+			return
+		}
+		for i := range got {
+			assert.Equal(t, expect[i].Dist, got[i].Dist)
+			assert.Equal(t, expect[i].Count, got[i].Count)
+			assert.Equal(t, counts[got[i].Point], got[i].Count)
+		}
+
+		got, _ = seg.Range(nil, q, 3, nil)
+		expect, _ = linear.Range(nil, q, 3, nil)
+		assert.Len(t, got, len(expect))
+	}
+}
+
+func TestTies(t *testing.T) {
+	// lenDist puts many points at equal distances. Number the points in
+	// reverse, so that ordering by ID differs from lexicographic order.
+	ids := make([]string, len(words))
+	for i := range words {
+		ids[i] = fmt.Sprintf("%05d", len(words)-i)
+	}
+	linear := vp.NewLinear(lenDist, words, ids)
+
+	type index interface {
+		SearchWith(context.Context, string, int, float64, vp.Predicate[string], vp.Options) ([]vp.Result[string], error)
+	}
+	var indexes []index
+	for _, seed := range []int64{1, 2, 3} {
+		opts := vp.BuildOptions{IDs: ids, Seed: seed}
+		tree, _ := vp.NewStringsWithIDs(nil, lenDist, words, ids, seed)
+		mvp, _ := vp.NewMVP(nil, lenDist, words, opts)
+		sh, _ := vp.NewSharded(nil, lenDist, words, 3, opts)
+		seg, _ := vp.NewSegmented(nil, lenDist, words, 0, opts)
+		indexes = append(indexes, tree, tree.Flatten(), mvp, sh, seg)
+	}
+
+	for _, q := range queryWords[:10] {
+		for _, ties := range []vp.TieBreak{vp.Lexicographic, vp.ByFrequency, vp.ByID} {
+			for _, include := range []bool{false, true} {
+				opts := vp.Options{Ties: ties, IncludeTies: include}
+				expect, _ := linear.SearchWith(nil, q, 5, math.Inf(+1), nil, opts)
+				for _, idx := range indexes {
+					got, _ := idx.SearchWith(nil, q, 5, math.Inf(+1), nil, opts)
+					if !assert.Equal(t, expect, got, "%T, %q, %v", idx, q, opts) {
+						return
+					}
+				}
+
+				if !include {
+					assert.Len(t, expect, 5)
+					continue
+				}
+				kth := expect[len(expect)-1].Dist
+				within, _ := linear.Range(nil, q, kth, nil)
+				assert.Len(t, expect, len(within))
+			}
+		}
+	}
+}
+
+func TestTreeStats(t *testing.T) {
+	m := func(a, b string) float64 {
+		return float64(levenshtein.DistanceCodepoints(a, b))
+	}
+	for _, leafSize := range []int{0, 8} {
+		tree, _ := vp.Build(nil, m, words, vp.BuildOptions{Seed: 3, LeafSize: leafSize})
+		st := tree.Stats()
+
+		assert.Equal(t, tree.Len(), st.Points)
+		assert.Less(t, st.Leaves, st.Nodes)
+		assert.Len(t, st.Levels, st.MaxDepth+1)
+		assert.Greater(t, st.MeanDepth, 0.)
+		assert.LessOrEqual(t, st.MeanDepth, float64(st.MaxDepth))
+		assert.Greater(t, st.Memory, int64(len(words)))
+
+		nodes, leaves, radii := 0, 0, 0
+		for _, lv := range st.Levels {
+			nodes += lv.Nodes
+			leaves += lv.Leaves
+			for _, n := range lv.Radii {
+				radii += n
+			}
+			assert.LessOrEqual(t, lv.MinRadius, lv.MaxRadius)
+		}
+		assert.Equal(t, st.Nodes, nodes)
+		assert.Equal(t, st.Leaves, leaves)
+		assert.Equal(t, st.Nodes-st.Leaves, radii)
+		if leafSize > 0 {
+			assert.Less(t, st.Nodes, len(words)/2)
+		}
+	}
+
+	empty, _ := vp.New(nil, lenDist, nil)
+	assert.Equal(t, vp.TreeStats{}, empty.Stats())
+}
+
+func TestPartial(t *testing.T) {
+	m := func(a, b string) float64 {
+		return float64(levenshtein.DistanceCodepoints(a, b))
+	}
+	tree, _ := vp.NewFromSeed(nil, m, words, 2)
+	mvp, _ := vp.NewMVP(nil, m, words, vp.BuildOptions{Seed: 2})
+	sh, _ := vp.NewSharded(nil, m, words, 2, vp.BuildOptions{Seed: 2})
+
+	type index interface {
+		Search(context.Context, string, int, float64, vp.Predicate[string]) ([]vp.Result[string], error)
+	}
+	for _, idx := range []index{tree, mvp, sh} {
+		// Cancel the search once it has found some points.
+		ctx, cancel := context.WithCancel(context.Background())
+		var n int32
+		pred := func(string) bool {
+			if atomic.AddInt32(&n, 1) == 12 {
+				cancel()
+			}
+			return true
+		}
+		got, err := idx.Search(ctx, "foo", 10, math.Inf(+1), pred)
+		assert.Equal(t, context.Canceled, err, "%T", idx)
+		assert.Len(t, got, 10, "%T", idx)
+		assert.True(t, sort.SliceIsSorted(got, func(i, j int) bool {
+			return got[i].Dist < got[j].Dist
+		}))
+		cancel()
+	}
+}
+
+func TestFarthest(t *testing.T) {
+	m, count := countingLevenshtein()
+	for _, leafSize := range []int{0, 8} {
+		tree, _ := vp.Build(nil, m, words, vp.BuildOptions{Seed: 4, LeafSize: leafSize})
+
+		for _, q := range queryWords[:20] {
+			expect := make([]vp.Result[string], len(words))
+			for i, w := range words {
+				expect[i] = vp.Result[string]{Dist: m(q, w), Point: w, Count: 1}
+			}
+			sort.Slice(expect, func(i, j int) bool {
+				a, b := &expect[i], &expect[j]
+				return a.Dist > b.Dist || a.Dist == b.Dist && a.Point < b.Point
+			})
+
+			*count = 0
+			got, err := tree.Farthest(nil, q, 5)
+			assert.NoError(t, err)
+			assert.Equal(t, expect[:5], got, "%q", q)
+			assert.Less(t, int(*count), len(words))
+		}
+	}
+
+	empty, _ := vp.New(nil, lenDist, nil)
+	got, err := empty.Farthest(nil, "foo", 3)
+	assert.NoError(t, err)
+	assert.Empty(t, got)
+}
+
+func TestOutliers(t *testing.T) {
+	m := func(a, b string) float64 {
+		return float64(levenshtein.DistanceCodepoints(a, b))
+	}
+	points := []string{"foo", "fool", "food", "bar", "baz", "quux", "zebra", "quux"}
+	tree, _ := vp.NewFromSeed(nil, m, points, 1)
+
+	got, err := tree.Outliers(nil, 1)
+	assert.NoError(t, err)
+	// quux occurs twice, so it is not an outlier.
+	assert.Equal(t, []vp.Result[string]{{Dist: 4, Point: "zebra", Count: 1}}, got)
+
+	got, _ = tree.Outliers(nil, 0)
+	assert.Len(t, got, 6)
+
+	single, _ := vp.New(nil, m, []string{"foo"})
+	got, _ = single.Outliers(nil, 1)
+	assert.Equal(t, []vp.Result[string]{{Dist: math.Inf(+1), Point: "foo", Count: 1}}, got)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = tree.Outliers(ctx, 1)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestSelfJoin(t *testing.T) {
+	m, count := countingLevenshtein()
+	points := append(words[:1000:1000], "foo")
+
+	type pair struct {
+		a, b string
+		d    float64
+	}
+	for _, leafSize := range []int{0, 8} {
+		tree, _ := vp.Build(nil, m, points, vp.BuildOptions{Seed: 6, LeafSize: leafSize})
+		for _, w := range points[:20] {
+			tree.Delete(w)
+		}
+		var live []string
+		tree.Do(func(s string) bool {
+			live = append(live, s)
+			return true
+		})
+
+		expect := make(map[pair]bool)
+		for i, a := range live {
+			for _, b := range live[i+1:] {
+				if d := m(a, b); d <= 2 && a < b {
+					expect[pair{a, b, d}] = true
+				} else if d <= 2 {
+					expect[pair{b, a, d}] = true
+				}
+			}
+		}
+
+		*count = 0
+		got := make(map[pair]bool)
+		err := tree.SelfJoin(nil, 2, func(p vp.Pair[string]) bool {
+			a, b := p.A.Point, p.B.Point
+			assert.Equal(t, p.A.Dist, p.B.Dist)
+			if b < a {
+				a, b = b, a
+			}
+			k := pair{a, b, p.A.Dist}
+			assert.False(t, got[k], "pair %v reported twice", k)
+			got[k] = true
+			return true
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, expect, got)
+		assert.Less(t, int(*count), len(live)*len(live)/4)
+
+		n := 0
+		err = tree.SelfJoin(nil, 2, func(vp.Pair[string]) bool {
+			n++
+			return n < 3
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tree, _ := vp.New(nil, m, words)
+	err := tree.SelfJoin(ctx, 2, func(vp.Pair[string]) bool { return true })
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestCluster(t *testing.T) {
+	m := func(a, b string) float64 {
+		return float64(levenshtein.DistanceCodepoints(a, b))
+	}
+	points := append(words[:1000:1000], "foo", "foo")
+	tree, _ := vp.Build(nil, m, points, vp.BuildOptions{Seed: 11, LeafSize: 4})
+	for _, w := range points[:10] {
+		tree.Delete(w)
+	}
+
+	for _, pred := range []vp.Predicate[string]{nil, func(s string) bool { return len(s) > 6 }} {
+		var live []string
+		tree.Do(func(s string) bool {
+			if pred == nil || pred(s) {
+				live = append(live, s)
+			}
+			return true
+		})
+		sort.Strings(live)
+
+		// Brute-force connected components.
+		comp := make([]int, len(live))
+		for i := range comp {
+			comp[i] = -1
+		}
+		for i := range live {
+			if comp[i] >= 0 {
+				continue
+			}
+			comp[i] = i
+			for stack := []int{i}; len(stack) > 0; {
+				a := live[stack[len(stack)-1]]
+				stack = stack[:len(stack)-1]
+				for j, b := range live {
+					if comp[j] < 0 && m(a, b) <= 2 {
+						comp[j] = i
+						stack = append(stack, j)
+					}
+				}
+			}
+		}
+		expect := make(map[int][]string)
+		for i, s := range live {
+			expect[comp[i]] = append(expect[comp[i]], s)
+		}
+
+		clusters, err := tree.Cluster(nil, 2, pred)
+		assert.NoError(t, err)
+		assert.Equal(t, len(expect), len(clusters))
+
+		var seen []string
+		for i, c := range clusters {
+			if i > 0 {
+				prev := clusters[i-1]
+				assert.True(t, len(prev.Members) > len(c.Members) ||
+					len(prev.Members) == len(c.Members) && prev.Medoid.Point < c.Medoid.Point)
+			}
+
+			assert.Equal(t, c.Medoid, c.Members[0])
+			assert.Equal(t, 0., c.Medoid.Dist)
+			sum := func(a string) (s float64) {
+				for _, r := range c.Members {
+					s += float64(r.Count) * m(a, r.Point)
+				}
+				return s
+			}
+			for _, r := range c.Members {
+				assert.Equal(t, m(c.Medoid.Point, r.Point), r.Dist)
+				assert.LessOrEqual(t, sum(c.Medoid.Point), sum(r.Point))
+				if r.Point == "foo" {
+					assert.Equal(t, 2, r.Count)
+				}
+			}
+
+			var members []string
+			for _, r := range c.Members {
+				members = append(members, r.Point)
+			}
+			sort.Strings(members)
+			seen = append(seen, members...)
+			i := sort.SearchStrings(live, members[0])
+			assert.Equal(t, expect[comp[i]], members)
+		}
+		sort.Strings(seen)
+		assert.Equal(t, live, seen)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	clusters, err := tree.Cluster(ctx, 2, nil)
+	assert.Nil(t, clusters)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestMedoid(t *testing.T) {
+	m, count := countingLevenshtein()
+
+	best, dists, err := vp.Medoid(nil, m, nil)
+	assert.Equal(t, -1, best)
+	assert.Nil(t, dists)
+	assert.NoError(t, err)
+
+	// "bar" and "baz" tie; "bar" comes first.
+	best, dists, _ = vp.Medoid(nil, m, []string{"foo", "baz", "bar", "quux"})
+	assert.Equal(t, 2, best)
+	assert.Equal(t, []float64{3, 1, 0, 4}, dists)
+
+	// Duplicates count.
+	best, _, _ = vp.Medoid(nil, m, []string{"colour", "color", "colour", "colours"})
+	assert.Equal(t, 0, best)
+
+	sum := func(points []string, a string) (s float64) {
+		for _, b := range points {
+			s += m(a, b)
+		}
+		return s
+	}
+	for _, n := range []int{100, 512, 1000} {
+		points := words[:n]
+		sums := make([]float64, n)
+		for i, p := range points {
+			sums[i] = sum(points, p)
+		}
+		sort.Float64s(sums)
+
+		*count = 0
+		best, dists, err := vp.Medoid(nil, m, points)
+		assert.NoError(t, err)
+		if n <= 512 {
+			assert.Equal(t, sums[0], sum(points, points[best]))
+		} else {
+			assert.Less(t, int(*count), n*n/4)
+			// Within the best one percent.
+			assert.LessOrEqual(t, sum(points, points[best]), sums[n/100])
+		}
+		for i, p := range points {
+			assert.Equal(t, m(points[best], p), dists[i])
+		}
+
+		again, _, _ := vp.Medoid(nil, m, points)
+		assert.Equal(t, best, again)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, n := range []int{100, 1000} {
+		best, dists, err := vp.Medoid(ctx, m, words[:n])
+		assert.Equal(t, -1, best)
+		assert.Nil(t, dists)
+		assert.Equal(t, context.Canceled, err)
+	}
+}
+
+func TestJoin(t *testing.T) {
+	m := func(a, b string) float64 {
+		return float64(levenshtein.DistanceCodepoints(a, b))
+	}
+	tree, _ := vp.NewFromSeed(nil, m, words[:1000], 9)
+	queries := append(queryWords[:len(queryWords):len(queryWords)], "foo", "foo")
+	qtree, _ := vp.NewFromSeed(nil, m, queries, 10)
+
+	opts := vp.Options{Ties: vp.Lexicographic}
+	var stats vp.Stats
+	matches, err := tree.Join(nil, queries, 3, 4, vp.Options{Ties: vp.Lexicographic, Stats: &stats})
+	assert.NoError(t, err)
+	assert.Len(t, matches, len(queries))
+	calls := 0
+	for i, match := range matches {
+		var st vp.Stats
+		expect, _ := tree.SearchWith(nil, queries[i], 3, 4, nil,
+			vp.Options{Ties: vp.Lexicographic, Stats: &st})
+		assert.Equal(t, queries[i], match.Query.Point)
+		assert.Equal(t, expect, match.Results)
+		calls += st.DistCalls
+	}
+	assert.Equal(t, calls, stats.DistCalls)
+
+	matches, err = tree.JoinTree(nil, qtree, 3, 4, opts)
+	assert.NoError(t, err)
+	assert.Len(t, matches, qtree.Len())
+	for i, match := range matches {
+		if i > 0 {
+			assert.Less(t, matches[i-1].Query.Point, match.Query.Point)
+		}
+		expect, _ := tree.SearchWith(nil, match.Query.Point, 3, 4, nil, opts)
+		assert.Equal(t, expect, match.Results)
+		if match.Query.Point == "foo" {
+			assert.Equal(t, 2, match.Query.Count)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = tree.Join(ctx, queries, 3, 4, opts)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestAssign(t *testing.T) {
+	match := func(q string, results ...vp.Result[string]) vp.Match[string] {
+		return vp.Match[string]{Query: vp.Result[string]{Point: q}, Results: results}
+	}
+	r := func(p string, d float64) vp.Result[string] {
+		return vp.Result[string]{Point: p, Dist: d, Count: 1}
+	}
+
+	// Giving q1 its nearest neighbor would leave q2 without one.
+	got := vp.Assign([]vp.Match[string]{
+		match("q1", r("a", 1), r("b", 2)),
+		match("q2", r("a", 1.5)),
+		match("q3"),
+	})
+	assert.Equal(t, []vp.Match[string]{
+		match("q1", r("b", 2)),
+		match("q2", r("a", 1.5)),
+		match("q3"),
+	}, got)
+
+	// Random instances, checked against all possible assignments.
+	rng := rand.New(rand.NewSource(11))
+	points := []string{"a", "b", "c", "d", "e"}
+	for iter := 0; iter < 200; iter++ {
+		matches := make([]vp.Match[string], 1+rng.Intn(5))
+		for i := range matches {
+			for _, p := range points {
+				if rng.Intn(2) == 0 {
+					matches[i].Results = append(matches[i].Results, r(p, float64(rng.Intn(5))))
+				}
+			}
+		}
+
+		got := vp.Assign(matches)
+		n, cost := 0, 0.
+		used := make(map[string]bool)
+		for i := range got {
+			if !assert.LessOrEqual(t, len(got[i].Results), 1) {
+				return
+			}
+			for _, r := range got[i].Results {
+				assert.False(t, used[r.Point])
+				assert.Contains(t, matches[i].Results, r)
+				used[r.Point] = true
+				n++
+				cost += r.Dist
+			}
+		}
+
+		bestN, bestCost := bestAssignment(matches, 0, make(map[string]bool))
+		assert.Equal(t, bestN, n)
+		assert.Equal(t, bestCost, cost)
+	}
+}
+
+// Returns the largest number of matches from i on that can be assigned
+// distinct points that are not used, and the least cost of doing so.
+func bestAssignment(matches []vp.Match[string], i int, used map[string]bool) (n int, cost float64) {
+	if i == len(matches) {
+		return 0, 0
+	}
+	n, cost = bestAssignment(matches, i+1, used)
+	for _, r := range matches[i].Results {
+		if used[r.Point] {
+			continue
+		}
+		used[r.Point] = true
+		n2, cost2 := bestAssignment(matches, i+1, used)
+		used[r.Point] = false
+		if n2+1 > n || n2+1 == n && cost2+r.Dist < cost {
+			n, cost = n2+1, cost2+r.Dist
+		}
+	}
+	return n, cost
+}
+
+func TestCounts(t *testing.T) {
+	m := func(a, b string) float64 {
+		return float64(levenshtein.DistanceCodepoints(a, b))
+	}
+	points := []string{"bar", "baz", "bar", "bat", "baz", "bar", "foo"}
+	tree, _ := vp.NewStringsFromSeed(nil, m, points, 2)
+	assert.Equal(t, 4, tree.Len())
+	tree.Insert(nil, "bat")
+	tree.Insert(nil, "bat")
+	tree.Insert(nil, "bat")
+	assert.Equal(t, 4, tree.Len())
+
+	var buf bytes.Buffer
+	tree.WriteTo(&buf)
+	flat, _ := vp.LoadFlat(buf.Bytes(), m, "", "")
+
+	opts := vp.Options{Ties: vp.ByFrequency}
+	expect := []vp.Result[string]{
+		{Point: "bat", Dist: 1, Count: 4},
+		{Point: "bar", Dist: 1, Count: 3},
+		{Point: "baz", Dist: 1, Count: 2},
+	}
+	for k := 1; k <= 3; k++ {
+		nn, _ := tree.SearchWith(nil, "bax", k, math.Inf(+1), nil, opts)
+		assert.Equal(t, expect[:k], nn)
+		nn, _ = flat.SearchWith(nil, "bax", k, math.Inf(+1), nil, opts)
+		assert.Equal(t, expect[:k], nn)
+	}
+}
+
+func TestCountsInterface(t *testing.T) {
+	// An interface type is comparable, but a []rune inside it is not.
+	m := func(a, b interface{}) float64 {
+		return float64(levenshtein.DistanceCodepoints(fmt.Sprint(a), fmt.Sprint(b)))
+	}
+	type pair struct{ a, b interface{} }
+	points := []interface{}{
+		"bar", []rune("bar"), "bar", []rune("bar"), 3, 3,
+		pair{1, 2}, pair{1, 2}, pair{1, []int{2}}, [1]interface{}{[]int{2}},
+	}
+	tree, _ := vp.NewFromSeed(nil, m, points, 5)
+	assert.Equal(t, 7, tree.Len())
+
+	nn, _ := tree.Search(nil, "bar", 1, math.Inf(+1), nil)
+	assert.Equal(t, []vp.Result[interface{}]{{Point: "bar", Count: 2}}, nn)
+	nn, _ = tree.Search(nil, 3, 1, math.Inf(+1), nil)
+	assert.Equal(t, []vp.Result[interface{}]{{Point: 3, Count: 2}}, nn)
+}
+
+func TestRunes(t *testing.T) {
+	m := func(a, b []rune) float64 {
+		return float64(levenshtein.DistanceRunes(a, b))
+	}
+	points := make([][]rune, len(words))
+	for i, w := range words {
+		points[i] = []rune(w)
+	}
+	tree, _ := vp.NewFromSeed(nil, m, points, 11)
+	assert.Equal(t, len(words), tree.Len())
+
+	for _, q := range queryWords {
+		nn, _ := tree.Search(nil, []rune(q), 3, math.Inf(+1), nil)
+		if !assert.Len(t, nn, 3) {
+			return
+		}
+		assert.Equal(t, q, string(nn[0].Point))
+		assert.Zero(t, nn[0].Dist)
+	}
+
+	assert.True(t, tree.Delete([]rune("foo")))
+	assert.False(t, tree.Delete([]rune("foo")))
+	nn, _ := tree.Range(nil, []rune("foo"), 0, nil)
+	assert.Empty(t, nn)
+	tree.Insert(nil, []rune("foo"), "1")
+	nn, _ = tree.Range(nil, []rune("foo"), 0, nil)
+	assert.Equal(t, []vp.Result[[]rune]{{Point: []rune("foo"), Count: 1, IDs: []string{"1"}}}, nn)
+}
+
 func TestSearch(t *testing.T) {
 	for i := 2; i < 8; i++ {
 		offset := rand.Intn(len(words) - i)
@@ -105,11 +1377,11 @@ func TestSearch(t *testing.T) {
 }
 
 func testSearch(t *testing.T, words []string) {
-	nn := make(map[string][]vp.Result)
+	nn := make(map[string][]vp.Result[string])
 
 	for _, q := range words {
 		for _, w := range words {
-			nn[q] = append(nn[q], vp.Result{Point: w, Dist: lenDist(w, q)})
+			nn[q] = append(nn[q], vp.Result[string]{Point: w, Dist: lenDist(w, q), Count: 1})
 		}
 
 		sort.Slice(nn[q], func(i, j int) bool {
@@ -174,7 +1446,67 @@ func BenchmarkSearch(b *testing.B) {
 	b.Run("Trivial-20NN", func(b *testing.B) { benchmarkSearch(b, t, 20) })
 }
 
-func benchmarkSearch(b *testing.B, t *vp.Tree, k int) {
+// BenchmarkJoinTree compares JoinTree, which runs an independent search for
+// every query, to the best a dual-tree join could do by bounding the search
+// for each query q with the results for its nearest neighbor q' in the tree
+// of queries: by the triangle inequality, the k-th nearest neighbor of q is
+// within d(q, q') plus that of q'. The bounded searches get q' and its
+// results for free; finding q' is measured separately, as "neighbor".
+// Compare the dists/query: with edit distances, bounding saves less than
+// a tenth of the distance computations, while finding q' costs more than
+// it saves.
+func BenchmarkJoinTree(b *testing.B) {
+	m, count := countingLevenshtein()
+	tree, _ := vp.NewFromSeed(nil, m, words, 42)
+
+	var queries []string
+	for i := 0; i < len(words); i += 4 {
+		queries = append(queries, words[i]+"s")
+	}
+	qtree, _ := vp.NewFromSeed(nil, m, queries, 43)
+
+	for _, k := range []int{1, 5, 20} {
+		matches, _ := tree.JoinTree(nil, qtree, k, math.Inf(+1), vp.Options{})
+		kth := make(map[string]float64)
+		for _, match := range matches {
+			kth[match.Query.Point] = match.Results[len(match.Results)-1].Dist
+		}
+		bounds := make([]float64, len(queries))
+		for i, q := range queries {
+			near, _ := qtree.Search(nil, q, 2, math.Inf(+1), nil)
+			bounds[i] = near[1].Dist + kth[near[1].Point]
+		}
+
+		b.Run(fmt.Sprintf("independent-%dNN", k), func(b *testing.B) {
+			*count = 0
+			for i := 0; i < b.N; i++ {
+				tree.JoinTree(nil, qtree, k, math.Inf(+1), vp.Options{})
+			}
+			b.ReportMetric(float64(*count)/float64(b.N*len(queries)), "dists/query")
+		})
+		b.Run(fmt.Sprintf("bounded-%dNN", k), func(b *testing.B) {
+			*count = 0
+			for i := 0; i < b.N; i++ {
+				for j, q := range queries {
+					tree.Search(nil, q, k, bounds[j], nil)
+				}
+			}
+			b.ReportMetric(float64(*count)/float64(b.N*len(queries)), "dists/query")
+		})
+	}
+
+	b.Run("neighbor", func(b *testing.B) {
+		*count = 0
+		for i := 0; i < b.N; i++ {
+			for _, q := range queries {
+				qtree.Search(nil, q, 2, math.Inf(+1), nil)
+			}
+		}
+		b.ReportMetric(float64(*count)/float64(b.N*len(queries)), "dists/query")
+	})
+}
+
+func benchmarkSearch(b *testing.B, t *vp.Tree[string], k int) {
 	ctx := context.Background()
 	for i := 0; i < b.N; i++ {
 		for _, w := range queryWords {
@@ -2,14 +2,17 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -20,12 +23,36 @@ func main() {
 	var (
 		addrparam = flag.String("addr", "",
 			"bind to this address (default: localhost with random port)")
-		debug  = flag.Bool("debug", false, "send debugging ouput to stderr")
-		format = flag.String("format", "lines", "input format: lines or json")
+		buildWorkers = flag.Int("build-workers", 0,
+			"maximum number of goroutines for building the index (default: GOMAXPROCS)")
+		cluster = flag.Float64("cluster", -1,
+			"write the clusters of strings linked within this distance to stdout as JSON lines, then exit")
+		clusterRegexp = flag.String("cluster-regexp", "",
+			"with -cluster, only cluster the strings that match this regular expression")
+		compare = flag.String("compare", "",
+			"compare search results with a linear scan for the queries in this file, then exit")
+		debug = flag.Bool("debug", false, "send debugging ouput to stderr")
+		flat  = flag.Bool("flat", false,
+			"use a compact, read-only index; memory-maps the snapshot with -load")
+		format    = flag.String("format", "lines", "input format: lines or json")
+		indexType = flag.String("index", "vp",
+			"index structure: vp (VP-tree), mvp (multi-vantage-point tree), bktree (BK-tree), linear or segmented")
+		leafSize = flag.Int("leaf-size", 0,
+			"store up to this many points in each leaf of the index")
+		load = flag.String("load", "",
+			"load the index from a snapshot instead of reading strings")
 		metric = flag.String("metric", "levenshtein",
 			"string distance metric to use")
 		normalFlag = flag.String("normalize", "",
 			"Unicode normalization: NFC, NFD, NFKC, NFKD or empty for none")
+		save = flag.String("save", "",
+			"write a snapshot of the index to this file")
+		segmentSize = flag.Int("segment-size", 1024,
+			"number of strings inserted into a segmented index before it builds a new VP-tree")
+		selfJoin = flag.Float64("selfjoin", -1,
+			"write all pairs of strings within this distance of each other to stdout as JSON lines, then exit")
+		shards = flag.Int("shards", 1,
+			"split the index into this many VP-trees that are searched in parallel")
 		timeout = flag.Int("timeout", 60, "request timeout in seconds")
 
 		err   error
@@ -36,6 +63,9 @@ func main() {
 	switch flag.NArg() {
 	case 0:
 	case 1:
+		if *load != "" {
+			log.Fatal("cannot both -load a snapshot and read strings")
+		}
 		if arg := flag.Args()[0]; arg != "-" {
 			input, err = os.Open(arg)
 			if err != nil {
@@ -48,45 +78,89 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *indexType != "vp" && (*flat || *load != "" || *save != "") {
+		log.Fatalf("-index %s cannot be combined with -flat, -load or -save",
+			*indexType)
+	}
+	if *compare != "" && *load != "" {
+		log.Fatal("-compare needs the input strings, not a -load snapshot")
+	}
+	if *shards > 1 && (*indexType != "vp" || *flat || *load != "" || *save != "") {
+		log.Fatal("-shards cannot be combined with -index, -flat, -load or -save")
+	}
+
 	normalize, err := normalForm(*normalFlag)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	readStrings := readLines
+	readRecords := readLines
 	switch strings.ToLower(*format) {
 	case "json":
-		readStrings = readJSON
+		readRecords = readJSON
 	case "lines":
 	default:
 		log.Fatalf("unknown input format %q", *format)
 	}
 
-	if *debug {
-		log.Printf("reading strings from %s", input.Name())
+	t := time.Duration(*timeout) * time.Second
+	idx := nnIndex{
+		buildWorkers: *buildWorkers,
+		debug:        *debug,
+		leafSize:     *leafSize,
+		flat:         *flat,
+		indexType:    *indexType,
+		metricName:   *metric,
+		normName:     strings.ToLower(*normalFlag),
+		normalize:    normalize,
+		segmentSize:  *segmentSize,
+		shards:       *shards,
+		timeout:      t,
+	}
+
+	var (
+		h    http.Handler
+		recs []record
+	)
+	if *load != "" {
+		h, err = loadSnapshot(&idx, *load)
+	} else {
+		h, recs, err = buildIndex(&idx, input, readRecords, normalize)
 	}
-	strs, err := readStrings(input)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if normalize != nil {
-		for i := range strs {
-			strs[i] = normalize(strs[i])
+	if *save != "" {
+		if err := saveSnapshot(&idx, *save); err != nil {
+			log.Fatal(err)
 		}
 	}
 
-	t := time.Duration(*timeout) * time.Second
-	idx := nnIndex{
-		debug:      *debug,
-		metricName: *metric,
-		normName:   strings.ToLower(*normalFlag),
-		normalize:  normalize,
-		timeout:    t,
+	if *compare != "" {
+		os.Exit(compareWithLinear(&idx, recs, *compare))
 	}
-	h, err := idx.init(strs)
-	if err != nil {
-		log.Fatal(err)
+	if *cluster >= 0 {
+		out := bufio.NewWriter(os.Stdout)
+		err := idx.writeClusters(context.Background(), *cluster, *clusterRegexp, out)
+		if err == nil {
+			err = out.Flush()
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *selfJoin >= 0 {
+		out := bufio.NewWriter(os.Stdout)
+		err := idx.selfJoin(context.Background(), *selfJoin, out)
+		if err == nil {
+			err = out.Flush()
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
 	addr := *addrparam
@@ -114,6 +188,123 @@ func main() {
 	log.Fatal(srv.Serve(ln))
 }
 
+// buildIndex reads records from input and builds idx from them.
+// It returns the records as well, with their keys normalized.
+func buildIndex(idx *nnIndex, input *os.File,
+	readRecords func(io.Reader) ([]record, error),
+	normalize func(string) string) (http.Handler, []record, error) {
+
+	if idx.debug {
+		log.Printf("reading strings from %s", input.Name())
+	}
+	recs, err := readRecords(input)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if normalize != nil {
+		for i := range recs {
+			recs[i].Key = normalize(recs[i].Key)
+		}
+	}
+
+	h, err := idx.initRecords(recs)
+	return h, recs, err
+}
+
+func loadSnapshot(idx *nnIndex, path string) (http.Handler, error) {
+	if idx.flat {
+		if idx.debug {
+			log.Printf("mapping %s", path)
+		}
+		b, err := mmap(path)
+		if err != nil {
+			return nil, err
+		}
+		h, err := idx.loadFlat(b)
+		if err != nil {
+			err = fmt.Errorf("%s: %v", path, err)
+		}
+		return h, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h, err := idx.load(f)
+	if err != nil {
+		err = fmt.Errorf("%s: %v", path, err)
+	}
+	return h, err
+}
+
+// compareWithLinear runs the queries in the file at path against idx and
+// a linear scan of the records that idx was built from, reporting
+// mismatches on stderr. It returns an exit status.
+func compareWithLinear(idx *nnIndex, recs []record, path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	queries, err := readLines(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	keys := make([]string, len(recs))
+	for i := range recs {
+		keys[i] = recs[i].Key
+	}
+	qs := make([]string, len(queries))
+	for i := range queries {
+		qs[i] = queries[i].Key
+	}
+	mismatches, err := idx.compare(keys, qs, os.Stderr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("%d of %d queries gave different results", mismatches, len(qs))
+	if mismatches > 0 {
+		return 1
+	}
+	return 0
+}
+
+// saveSnapshot writes idx to a temporary file, then renames that to path,
+// so that an existing snapshot is never left half-written.
+func saveSnapshot(idx *nnIndex, path string) error {
+	if idx.debug {
+		log.Printf("saving index to %s", path)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	wt, ok := idx.index.(io.WriterTo)
+	if !ok {
+		err = fmt.Errorf("cannot save a snapshot of a %s index", idx.indexType)
+	} else {
+		_, err = wt.WriteTo(f)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	return err
+}
+
 // normalForm returns a Unicode normalization function.
 func normalForm(name string) (nf func(string) string, err error) {
 	switch strings.ToLower(name) {
@@ -132,23 +323,55 @@ func normalForm(name string) (nf func(string) string, err error) {
 	return
 }
 
-func readLines(r io.Reader) (strs []string, err error) {
+// A record is an item of input. Key is the string to be indexed.
+// ID and Data are optional and are returned along with Key when it
+// is found by a search.
+type record struct {
+	ID   json.RawMessage `json:"id,omitempty"`
+	Key  string          `json:"key"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+func readLines(r io.Reader) (recs []record, err error) {
 	sc := bufio.NewScanner(r)
 	for sc.Scan() {
-		strs = append(strs, sc.Text())
+		recs = append(recs, record{Key: sc.Text()})
 	}
-	return strs, sc.Err()
+	return recs, sc.Err()
+}
+
+// encodeID returns the JSON encoding of rec without its key, which the
+// index stores as an identifier of the key.
+func (rec *record) encodeID() (string, error) {
+	b, err := json.Marshal(struct {
+		ID   json.RawMessage `json:"id,omitempty"`
+		Data json.RawMessage `json:"data,omitempty"`
+	}{rec.ID, rec.Data})
+	return string(b), err
 }
 
-func readJSON(r io.Reader) (strs []string, err error) {
-	dec := json.NewDecoder(os.Stdin)
+// readJSON reads a stream of JSON values, each of which is either a string
+// or an object representing a record.
+func readJSON(r io.Reader) (recs []record, err error) {
+	dec := json.NewDecoder(r)
 	for dec.More() {
-		var s string
-		err = dec.Decode(&s)
+		var raw json.RawMessage
+		err = dec.Decode(&raw)
+		if err != nil {
+			break
+		}
+
+		var rec record
+		if len(raw) > 0 && raw[0] == '"' {
+			err = json.Unmarshal(raw, &rec.Key)
+		} else {
+			err = json.Unmarshal(raw, &rec)
+		}
 		if err != nil {
+			err = fmt.Errorf("record %d: %v", len(recs)+1, err)
 			break
 		}
-		strs = append(strs, s)
+		recs = append(recs, rec)
 	}
 	return
 }
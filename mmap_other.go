@@ -0,0 +1,12 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package main
+
+import "io/ioutil"
+
+// mmap reads the file at path into memory. This is the fallback for
+// platforms where we don't do memory-mapping.
+func mmap(path string) ([]byte, error) {
+	return ioutil.ReadFile(path)
+}
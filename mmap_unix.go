@@ -0,0 +1,35 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// mmap maps the file at path into memory, read-only.
+// The mapping is never removed.
+func mmap(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	switch {
+	case size == 0:
+		return nil, nil
+	case int64(int(size)) != size:
+		return nil, fmt.Errorf("%s: too large to map into memory", path)
+	}
+
+	return syscall.Mmap(int(f.Fd()), 0, int(size),
+		syscall.PROT_READ, syscall.MAP_SHARED)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/knaw-huc/levenserv/internal/vp"
+)
+
+// A joinIndex supports similarity self-joins.
+type joinIndex interface {
+	index
+	SelfJoin(ctx context.Context, threshold float64, f func(vp.Pair[string]) bool) error
+}
+
+var errNoJoin = errors.New(
+	"self-joins are only available for unsharded, non-flat vp indexes")
+
+// A pairHit is a pair of strings as sent to the client. The distance of
+// each of its hits is the distance between them.
+type pairHit struct {
+	A hit `json:"a"`
+	B hit `json:"b"`
+}
+
+// selfJoin writes every pair of strings in i.index within distance
+// threshold of each other to w, as newline-delimited JSON.
+func (i *nnIndex) selfJoin(ctx context.Context, threshold float64, w io.Writer) error {
+	idx, ok := i.index.(joinIndex)
+	if !ok {
+		return errNoJoin
+	}
+
+	var (
+		enc  = json.NewEncoder(w)
+		werr error
+	)
+	err := idx.SelfJoin(ctx, threshold, func(p vp.Pair[string]) bool {
+		hits := toHits([]vp.Result[string]{p.A, p.B})
+		werr = enc.Encode(pairHit{A: hits[0], B: hits[1]})
+		return werr == nil
+	})
+	if werr != nil {
+		return werr
+	}
+	return err
+}